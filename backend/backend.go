@@ -0,0 +1,489 @@
+// Package backend defines BackendFS, the interface a filesystem implements
+// to be served over FUSE by package fusefs, and the types it uses.
+package backend
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Inode attributes. A backend that reuses inode numbers should give the inode
+// reusing a number a Generation different from that of any inode that used
+// the number before, so that fusefs never takes it for the old inode.
+type Stat struct {
+	Ino        uint64      // Inode number
+	Generation uint64      // Generation number
+	Mode       os.FileMode // File type and mode
+	Nlink      uint32      // Number of hard links
+	UID        uint32      // User ID of owner
+	GID        uint32      // Group ID of owner
+	Rdev       uint32      // Device ID (if special file)
+	Size       uint64      // Total size in bytes
+	Blocks     uint64      // Number of blocks allocated
+	BlockSize  uint32      // Block size for filesystem I/O
+	Atime      time.Time   // Time of last access
+	Mtime      time.Time   // Time of last modification
+	Ctime      time.Time   // Time of last status change
+	Crtime     time.Time   // Time of creation
+}
+
+// SetattrValid is a bit mask of the attributes changed by a SetattrRequest
+type SetattrValid uint32
+
+const (
+	SetattrMode   SetattrValid = 1 << iota // Set Mode, by chmod(2)
+	SetattrUID                             // Set UID, by chown(2)
+	SetattrGID                             // Set GID, by chown(2)
+	SetattrSize                            // Set Size, by truncate(2)
+	SetattrAtime                           // Set Atime, by utimensat(2)
+	SetattrMtime                           // Set Mtime, by utimensat(2)
+	SetattrCtime                           // Set Ctime
+	SetattrHandle                          // Changed through Handle
+)
+
+// SetattrRequest describes the attributes of an inode to change. Only the
+// attributes in Valid are changed.
+type SetattrRequest struct {
+	Valid SetattrValid
+	Mode  os.FileMode
+	UID   uint32
+	GID   uint32
+	Size  uint64
+	Atime time.Time
+	Mtime time.Time
+
+	// Ctime is set to the current time whenever any attribute is changed,
+	// unless SetattrCtime is set
+	Ctime time.Time
+
+	// Handle of the open file through which the attributes are changed,
+	// such as by ftruncate(2), if SetattrHandle is set
+	Handle HandleID
+}
+
+// HandleID is an opaque identifier of an open file or directory. It is
+// generated by backend on Open or Create, and passed back to the backend on
+// every operation on the open file, which allows the backend to keep
+// per-open state such as a cursor or a session with remote storage.
+type HandleID uint64
+
+// Flags for Setxattr, same as XATTR_CREATE and XATTR_REPLACE on Linux
+const (
+	XattrCreate  = 0x1 // Fail if the named attribute already exists
+	XattrReplace = 0x2 // Fail if the named attribute does not exist
+)
+
+// Flags for Rename, same as RENAME_* on Linux
+const (
+	RenameNoreplace = 0x1 // Do not overwrite the new name
+	RenameExchange  = 0x2 // Exchange the old and new names
+	RenameWhiteout  = 0x4 // Leave a whiteout in place of the old name
+)
+
+// Modes of Fallocate, same as FALLOC_FL_* on Linux
+const (
+	FallocKeepSize  = 0x01 // Do not change file size
+	FallocPunchHole = 0x02 // Deallocate range, used with FallocKeepSize
+	FallocZeroRange = 0x10 // Zero range, allocating it
+)
+
+// Whence values of Seeker.Lseek, same as SEEK_DATA and SEEK_HOLE on Linux
+const (
+	SeekData = 3 // Seek to the next data
+	SeekHole = 4 // Seek to the next hole
+)
+
+// Filesystem statistics
+type Statfs struct {
+	Blocks  uint64 // Total data blocks in filesystem
+	Bfree   uint64 // Free blocks in filesystem
+	Bavail  uint64 // Free blocks available to unprivileged user
+	Files   uint64 // Total file nodes in filesystem
+	Ffree   uint64 // Free file nodes in filesystem
+	Bsize   uint32 // Block size, in which Blocks, Bfree and Bavail are counted
+	Namelen uint32 // Maximum length of filenames
+}
+
+type Dirent struct {
+	Ino  uint64      // Inode number
+	Name string      // Name of entry
+	Type os.FileMode // Type of file: mode & os.ModeType
+
+	// Marker of the position right after the entry, set by Readdir. Reading
+	// from it continues with the entry next to this one.
+	Marker string
+}
+
+// ChangeKind is the kind of a change made to a backend
+type ChangeKind int
+
+const (
+	ChangeData  ChangeKind = iota // Data of a file changes
+	ChangeAttr                    // Attributes of an inode change
+	ChangeEntry                   // Entries of a directory change
+)
+
+// Change describes a change made to a backend by others than the mount, such
+// as another client of a shared storage
+type Change struct {
+	Kind ChangeKind
+	Ino  uint64 // Inode that changes, the directory for ChangeEntry
+	Name string // Name of the entry, for ChangeEntry
+
+	// Range of data that changes, for ChangeData. Length <= 0 means the data
+	// from Offset to the end of file.
+	Offset int64
+	Length int64
+}
+
+// Notifier is implemented by backends that may be changed by others than the
+// mount. The kernel caches attributes, entries and data of files, which
+// would be stale after such changes unless it is told about them.
+type Notifier interface {
+	// Changes returns a channel on which the backend sends the changes made
+	// by others. The channel is closed when the backend stops reporting
+	// changes.
+	Changes() <-chan Change
+}
+
+// AtimePolicy selects when the access time of a file is updated on reading
+// its data
+type AtimePolicy int
+
+const (
+	// Relatime updates the access time only if it is earlier than the
+	// modification or change time, or it is older than a day, which is the
+	// default of Linux
+	Relatime AtimePolicy = iota
+
+	// Strictatime updates the access time on every read
+	Strictatime
+
+	// Noatime never updates the access time
+	Noatime
+)
+
+var atimePolicyNames = []string{"relatime", "strictatime", "noatime"}
+
+// ParseAtimePolicy parses the name of an atime policy, which is the same as
+// the mount option of Linux
+func ParseAtimePolicy(name string) (AtimePolicy, error) {
+	for i, n := range atimePolicyNames {
+		if n == name {
+			return AtimePolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown atime policy %q", name)
+}
+
+func (p AtimePolicy) String() string {
+	if p < 0 || int(p) >= len(atimePolicyNames) {
+		return fmt.Sprintf("AtimePolicy(%d)", int(p))
+	}
+	return atimePolicyNames[p]
+}
+
+// ShouldUpdate reports whether the access time of a file is updated to now
+// when its data is read, given its current access, modification and change
+// times.
+func (p AtimePolicy) ShouldUpdate(atime, mtime, ctime, now time.Time) bool {
+	switch p {
+	case Strictatime:
+		return true
+	case Noatime:
+		return false
+	}
+	return !atime.After(mtime) || !atime.After(ctime) ||
+		now.Sub(atime) >= 24*time.Hour
+}
+
+// CacheConfig controls how the kernel caches a filesystem
+type CacheConfig struct {
+	AttrTimeout  time.Duration // How long attributes are cached
+	EntryTimeout time.Duration // How long names are cached
+
+	// If set, the kernel caches writes and sends them to the filesystem
+	// later, instead of writing through on every write
+	WritebackCache bool
+
+	// If set, the kernel keeps data cached when a file is opened. Otherwise,
+	// the data cached is invalidated on every open.
+	KeepCache bool
+
+	// If set, reads and writes bypass the page cache of the kernel, which
+	// also disables mmap of files
+	DirectIO bool
+}
+
+// DefaultCacheConfig is used for backends that do not implement CacheAdviser
+var DefaultCacheConfig = CacheConfig{
+	AttrTimeout:  time.Minute,
+	EntryTimeout: time.Minute,
+}
+
+// CacheAdviser is implemented by backends that know how they may be cached.
+// A backend that may be changed by others than the mount needs short
+// timeouts, while a backend only changed through the mount may be cached
+// for long. Mount options override the advice.
+type CacheAdviser interface {
+	CacheConfig() CacheConfig
+}
+
+// Caller identifies the process that makes a request
+type Caller struct {
+	UID uint32 // User ID of the process
+	GID uint32 // Group ID of the process
+	PID uint32 // Process ID, 0 for requests made by the kernel itself
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context carrying caller
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller carried by ctx, if any
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+// BackendFS is the filesystem interface for FUSE backend.
+//
+// Every method but Close takes the context of the request it serves, which
+// carries the Caller of the request, and is canceled when the request is
+// interrupted, such as by a signal to the caller. A backend doing slow work
+// should give up on cancellation and return syscall.EINTR.
+type BackendFS interface {
+	// Statfs returns statistics of the filesystem, such as total and free
+	// blocks and inodes.
+	Statfs(ctx context.Context) (*Statfs, error)
+
+	// Stat returns a Stat (struct) describing attributes of an inode, or an
+	// error, if any happens.
+	Stat(ctx context.Context, ino uint64) (*Stat, error)
+
+	// Open opens a file or a directory, returning a handle of the open file,
+	// or an error if any happens.
+	// flags never contains O_TRUNC: the kernel truncates a file opened with
+	// O_TRUNC by Setattr of SetattrSize without a handle.
+	Open(ctx context.Context, ino uint64, flags int) (HandleID, error)
+
+	// Create creates a file in a directory and opens it, returning attributes
+	// of inode of the created file and a handle of the open file, or an error
+	// (if any happens).
+	// uid and gid are the user ID and group ID of the creator, which become
+	// the owner of the file. The same applies to Mkdir, Mknod and Symlink.
+	Create(ctx context.Context, ino uint64, name string, flags int,
+		mode os.FileMode, uid, gid uint32) (*Stat, HandleID, error)
+
+	// Mkdir creates a directory in the filesystem
+	Mkdir(ctx context.Context, ino uint64, name string, mode os.FileMode,
+		uid, gid uint32) (*Stat, error)
+
+	// Mknod creates a filesystem node (a regular file, a named pipe, a UNIX
+	// domain socket or a device special file) named name in the directory
+	// identified by ino. The type of the node is given by mode & os.ModeType;
+	// rdev is the device number and is only meaningful for device files.
+	// Mknod returns attributes of the created node on success.
+	Mknod(ctx context.Context, ino uint64, name string, mode os.FileMode,
+		rdev uint32, uid, gid uint32) (*Stat, error)
+
+	// Rmdir deletes a directory, which must be empty
+	Rmdir(ctx context.Context, ino uint64, name string) error
+
+	// Unlink deletes a name and possibly the file it refers to
+	Unlink(ctx context.Context, ino uint64, name string) error
+
+	// Rename changes the name or location of a file or a directory
+	// sIno is inode number of the old directory where lies the file being
+	// renamed; sName is the old name of the file; dIno is the inode number
+	// of the destination directory; dName is the new name specified
+	//
+	// flags is a bitwise OR of the following, as in renameat2(2):
+	//   RenameNoreplace: fail with syscall.EEXIST if dName exists
+	//   RenameExchange: atomically exchange sName and dName, which must both
+	//     exist, or fail with syscall.ENOENT
+	//   RenameWhiteout: leave a whiteout, which is a character device with
+	//     device number 0, in place of sName. It is used by overlay/union
+	//     filesystems to hide entries of lower layers.
+	// RenameExchange may not be combined with other flags. Rename returns
+	// syscall.EINVAL for unsupported flags.
+	// Note that fusefs renames with flags 0 only, since bazil.org/fuse does
+	// not decode RENAME2 requests, which renameat2(2) fails with EINVAL.
+	Rename(ctx context.Context, sIno uint64, sName string,
+		dIno uint64, dName string, flags uint32) error
+
+	// Link makes a new name for a file. ino is the inode number of the file,
+	// dIno is the inode number of the destination directory, dName is the
+	// new name given.
+	// Link will return attributes of the file on success.
+	Link(ctx context.Context,
+		ino uint64, dIno uint64, dName string) (*Stat, error)
+
+	// Symlink creates a symbolic link named name in the directory identified
+	// by ino. The link contains the string target, which is not interpreted
+	// by the filesystem. Symlink returns attributes of the link on success.
+	Symlink(ctx context.Context, ino uint64, name string, target string,
+		uid, gid uint32) (*Stat, error)
+
+	// Readlink returns the target of the symbolic link identified by ino.
+	Readlink(ctx context.Context, ino uint64) (string, error)
+
+	// Setattr sets attributes of a file or directory as req describes.
+	// req.Valid is always not zero.
+	// Setattr will return the updated attributes on success.
+	Setattr(ctx context.Context, ino uint64, req *SetattrRequest) (*Stat, error)
+
+	// Getxattr returns the value of the extended attribute name of the inode
+	// identified by ino. It returns syscall.ENODATA if there is no such
+	// attribute.
+	Getxattr(ctx context.Context, ino uint64, name string) ([]byte, error)
+
+	// Listxattr returns names of all extended attributes of an inode.
+	Listxattr(ctx context.Context, ino uint64) ([]string, error)
+
+	// Setxattr sets the value of the extended attribute name of an inode.
+	// flags is either 0, XattrCreate or XattrReplace. With XattrCreate,
+	// Setxattr fails with syscall.EEXIST if the attribute already exists;
+	// with XattrReplace, it fails with syscall.ENODATA if the attribute does
+	// not exist.
+	Setxattr(ctx context.Context,
+		ino uint64, name string, value []byte, flags uint32) error
+
+	// Removexattr removes the extended attribute name of an inode. It
+	// returns syscall.ENODATA if there is no such attribute.
+	Removexattr(ctx context.Context, ino uint64, name string) error
+
+	// Lookup looks up an inode in a parent directory.
+	Lookup(ctx context.Context, ino uint64, name string) (*Stat, error)
+
+	// Readdir reads the contents of a directory and returns a slice of up to
+	// n Dirent values, in directory order. The start position of reading is
+	// specified by marker, which is generated by server during last call to
+	// Readdir.
+	// If marker is an empty string, Readdir reads the first n Dirent in a
+	// directory
+	//
+	// If n <= 0, Readdir returns all the Dirent from the directory in a
+	// single slice starting from position indicated by marker.
+	//
+	// The second value that Readdir returns is a new marker generated by server
+	// for reading remaining Dirents. An empty string value indicates that no
+	// more Dirents in the directory.
+	//
+	// Markers should stay valid while entries are added to or removed from
+	// the directory, so that a reader neither skips nor repeats entries that
+	// are not changed meanwhile. A marker which is a decimal number less than
+	// 2^63 is used as a readdir offset directly, which saves FuseHandle from
+	// remembering markers it has handed out.
+	Readdir(ctx context.Context,
+		ino uint64, marker string, n int) ([]Dirent, string, error)
+
+	// Read reads up to n bytes from the file identified by ino, which is
+	// opened as fh, starting at a specified byte offset. It returns a slice of
+	// bytes read and any error encountered.
+	//
+	// If n <= 0, Read returns all bytes from a file starting at the
+	// specified offset.
+	// If n > 0, Read should return exactly n bytes except on EOF or error
+	Read(ctx context.Context,
+		ino uint64, fh HandleID, offset int64, n int) ([]byte, error)
+
+	// Write writes len(data) bytes to the file identified by ino, which is
+	// opened as fh, starting at a specified byte offset. It returns the number
+	// of bytes written and an error, if any. It returns a non-nil error when
+	// data is not fully written
+	//
+	// If fh is opened with O_APPEND, offset is ignored and data is appended
+	// to the end of file atomically.
+	Write(ctx context.Context,
+		ino uint64, fh HandleID, offset int64, data []byte) (int, error)
+
+	// Fallocate manipulates the space allocated to range
+	// [offset, offset+length) of the file identified by ino, which is opened
+	// as fh. If mode is 0, Fallocate allocates the range and extends the file
+	// if the range goes beyond the end of file; FallocKeepSize keeps the file
+	// size unchanged. FallocPunchHole deallocates the range, and
+	// FallocZeroRange zeros it. Reading a deallocated range returns zeros.
+	// Fallocate returns syscall.EOPNOTSUPP for modes it does not support.
+	Fallocate(ctx context.Context,
+		ino uint64, fh HandleID, offset, length int64, mode uint32) error
+
+	// Fsync synchronizes file contents with the backend storage. fh is the
+	// handle of the open file synchronized, or 0 if fusefs does not know it,
+	// in which case the file is synchronized as a whole.
+	//
+	// If the datasync parameter is non-zero, only file data should be
+	// synchronized, not metadata.
+	Fsync(ctx context.Context,
+		ino uint64, fh HandleID, datasync uint32, dir bool) error
+
+	// Flush will be called on each close() of an open file. It should be used
+	// to implement flush-on-close semantics.
+	Flush(ctx context.Context, ino uint64, fh HandleID) error
+
+	// Getlk returns a POSIX record lock that prevents lk from being placed on
+	// the file identified by ino, or nil if there is no such lock.
+	Getlk(ctx context.Context, ino uint64, lk *FileLock) (*FileLock, error)
+
+	// Setlk acquires or releases (if lk.Type is LockUnlock) a POSIX record
+	// lock on the file identified by ino. If a conflicting lock is held by
+	// another owner, Setlk returns syscall.EAGAIN if wait is false, otherwise
+	// it waits for the lock to be released, or returns syscall.EINTR if ctx
+	// is canceled meanwhile.
+	Setlk(ctx context.Context, ino uint64, lk *FileLock, wait bool) error
+
+	// Flock acquires or releases (if typ is LockUnlock) a BSD lock on the
+	// whole file identified by ino on behalf of owner. If the lock is held by
+	// others, Flock returns syscall.EWOULDBLOCK if wait is false, otherwise it
+	// waits for the lock to be released, or returns syscall.EINTR if ctx is
+	// canceled meanwhile.
+	Flock(ctx context.Context,
+		ino uint64, owner uint64, typ LockType, wait bool) error
+
+	// Release will be called when the last reference to an open file is closed.
+	// flags will contain the same flags as Open. fh is no longer used after
+	// Release.
+	// Under Linux, Release is called asynchronously with close() syscall;
+	// the PID in the corresponding FUSE request is 0, which indicates that the
+	// requester is the kernel instead of a user process.
+	Release(ctx context.Context, ino uint64, fh HandleID, flags int) error
+
+	// Close is called once when the filesystem is unmounted, after which no
+	// other method is called. The backend should flush its state to the
+	// backend storage and release its resources.
+	Close() error
+}
+
+// Seeker is implemented by backends that find the holes of sparse files.
+// Note that fusefs does not serve LSEEK requests, which bazil.org/fuse does
+// not decode, so lseek(2) on a mount finds no holes but at the end of file.
+type Seeker interface {
+	// Lseek returns the offset of the next data (whence is SeekData) or the
+	// next hole (whence is SeekHole) at or after offset in the file
+	// identified by ino, which is opened as fh. The end of file is treated
+	// as a hole. Lseek returns syscall.ENXIO if offset is beyond the end of
+	// file, or there is no data after offset when seeking data.
+	Lseek(ctx context.Context,
+		ino uint64, fh HandleID, offset int64, whence int) (int64, error)
+}
+
+// RangeCopier is implemented by backends that copy data between files
+// without passing it through the caller, such as by sharing the storage.
+// Note that fusefs does not serve COPY_FILE_RANGE requests, which
+// bazil.org/fuse does not decode, so the kernel copies files on a mount
+// through Read and Write.
+type RangeCopier interface {
+	// CopyFileRange copies length bytes from offset of the file identified
+	// by ino, which is opened as fh, to dOffset of the file identified by
+	// dIno, which is opened as dFh. It returns the number of bytes copied,
+	// which is less than length if the end of the source file is reached.
+	// The files may be the same, but the ranges may not overlap.
+	CopyFileRange(ctx context.Context, ino uint64, fh HandleID, offset int64,
+		dIno uint64, dFh HandleID, dOffset int64, length int64) (int64, error)
+}
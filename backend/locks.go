@@ -0,0 +1,294 @@
+package backend
+
+import (
+	"math"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+// LockType is the type of an advisory lock
+type LockType int
+
+const (
+	LockUnlock LockType = iota // Unlock
+	LockRead                   // Shared lock
+	LockWrite                  // Exclusive lock
+)
+
+// LockEOF is the End of a lock that extends to the end of file
+const LockEOF = math.MaxUint64
+
+// FileLock describes a POSIX record lock on a byte range of a file
+type FileLock struct {
+	Type  LockType
+	Start uint64 // First byte of the range
+	End   uint64 // Last byte of the range (inclusive), or LockEOF
+	Owner uint64 // Opaque identifier of lock owner
+	Pid   uint32 // Process holding the lock, reported by Getlk
+}
+
+func (lk *FileLock) overlaps(other *FileLock) bool {
+	return lk.Start <= other.End && other.Start <= lk.End
+}
+
+func (lk *FileLock) conflicts(other *FileLock) bool {
+	return lk.Owner != other.Owner && lk.overlaps(other) &&
+		(lk.Type == LockWrite || other.Type == LockWrite)
+}
+
+// LockManager keeps track of advisory locks of files. It implements POSIX
+// record locks (fcntl) and BSD locks (flock), which are independent of
+// each other as on Linux. A backend may use a LockManager to implement
+// Getlk, Setlk and Flock of BackendFS.
+type LockManager struct {
+	mu    sync.Mutex // protects the following fields
+	files map[uint64]*fileLocks
+
+	// Owner -> owner whose lock it is waiting for, used for detecting
+	// deadlocks between POSIX lock owners
+	waitsFor map[uint64]uint64
+}
+
+// fileLocks holds the locks of a single file
+type fileLocks struct {
+	posix  []FileLock
+	flocks map[uint64]LockType // Owner -> lock type
+
+	// Closed and replaced whenever a lock is released, waking up all the
+	// waiters, which then retry
+	released chan struct{}
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{
+		files:    make(map[uint64]*fileLocks),
+		waitsFor: make(map[uint64]uint64),
+	}
+}
+
+// This method should be called with lock being held
+func (m *LockManager) load(ino uint64) *fileLocks {
+	fl, ok := m.files[ino]
+	if !ok {
+		fl = &fileLocks{
+			flocks:   make(map[uint64]LockType),
+			released: make(chan struct{}),
+		}
+		m.files[ino] = fl
+	}
+	return fl
+}
+
+// This method should be called with lock being held
+func (m *LockManager) notify(ino uint64, fl *fileLocks) {
+	close(fl.released)
+	fl.released = make(chan struct{})
+	if len(fl.posix) == 0 && len(fl.flocks) == 0 {
+		delete(m.files, ino)
+	}
+}
+
+// Getlk returns a POSIX lock that conflicts with lk, or nil if lk could be
+// placed on the file identified by ino.
+func (m *LockManager) Getlk(ino uint64, lk *FileLock) *FileLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fl, ok := m.files[ino]
+	if !ok {
+		return nil
+	}
+	if c := fl.conflict(lk); c != nil {
+		res := *c
+		return &res
+	}
+	return nil
+}
+
+// This method should be called with lock being held
+func (fl *fileLocks) conflict(lk *FileLock) *FileLock {
+	if lk.Type == LockUnlock {
+		return nil
+	}
+	for i := range fl.posix {
+		if fl.posix[i].conflicts(lk) {
+			return &fl.posix[i]
+		}
+	}
+	return nil
+}
+
+// Setlk acquires (lk.Type is LockRead or LockWrite) or releases (lk.Type is
+// LockUnlock) a POSIX lock on the file identified by ino. If a conflicting
+// lock is held by another owner, Setlk returns syscall.EAGAIN when wait is
+// false, otherwise it blocks until the conflicting lock is released, or
+// returns syscall.EDEADLK if waiting would cause a deadlock. Waiting is given
+// up with syscall.EINTR when ctx is canceled.
+func (m *LockManager) Setlk(
+	ctx context.Context, ino uint64, lk *FileLock, wait bool) error {
+	if lk.Start > lk.End {
+		return syscall.EINVAL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		fl := m.load(ino)
+		c := fl.conflict(lk)
+		if c == nil {
+			fl.replace(lk)
+			if lk.Type != LockWrite {
+				// Unlocking or downgrading a range may unblock waiters
+				m.notify(ino, fl)
+			}
+			return nil
+		}
+		if !wait {
+			return syscall.EAGAIN
+		}
+		if m.deadlocks(lk.Owner, c.Owner) {
+			return syscall.EDEADLK
+		}
+
+		released := fl.released
+		m.waitsFor[lk.Owner] = c.Owner
+		m.mu.Unlock()
+		err := waitRelease(ctx, released)
+		m.mu.Lock()
+		delete(m.waitsFor, lk.Owner)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deadlocks reports whether owner waiting for blocker closes a cycle of lock
+// owners waiting for each other.
+// This method should be called with lock being held
+func (m *LockManager) deadlocks(owner, blocker uint64) bool {
+	for i := 0; i <= len(m.waitsFor); i++ {
+		if blocker == owner {
+			return true
+		}
+		next, ok := m.waitsFor[blocker]
+		if !ok {
+			return false
+		}
+		blocker = next
+	}
+	return false
+}
+
+// replace replaces locks held by lk.Owner in range of lk with lk. Existing
+// locks partially covered by lk are split. Adjacent or overlapping locks of
+// the same type are merged.
+// This method should be called with lock being held
+func (fl *fileLocks) replace(lk *FileLock) {
+	merged := *lk
+	res := make([]FileLock, 0, len(fl.posix)+2)
+	for _, l := range fl.posix {
+		if l.Owner != lk.Owner {
+			res = append(res, l)
+			continue
+		}
+		if l.Type == lk.Type && lk.Type != LockUnlock &&
+			(l.overlaps(lk) || adjacent(&l, lk)) {
+			// Merge into the new lock
+			if l.Start < merged.Start {
+				merged.Start = l.Start
+			}
+			if l.End > merged.End {
+				merged.End = l.End
+			}
+			continue
+		}
+		if !l.overlaps(lk) {
+			res = append(res, l)
+			continue
+		}
+		if l.Start < lk.Start {
+			head := l
+			head.End = lk.Start - 1
+			res = append(res, head)
+		}
+		if l.End > lk.End {
+			tail := l
+			tail.Start = lk.End + 1
+			res = append(res, tail)
+		}
+	}
+	if lk.Type != LockUnlock {
+		res = append(res, merged)
+	}
+	fl.posix = res
+}
+
+func adjacent(a, b *FileLock) bool {
+	return (a.End != LockEOF && a.End+1 == b.Start) ||
+		(b.End != LockEOF && b.End+1 == a.Start)
+}
+
+// Flock acquires (typ is LockRead or LockWrite) or releases (typ is
+// LockUnlock) a BSD lock on the whole file identified by ino on behalf of
+// owner, which is usually an open file. Converting an existing lock is not
+// atomic, as with flock(2). If the lock is held by others, Flock returns
+// syscall.EWOULDBLOCK when wait is false, otherwise it blocks until the
+// lock can be acquired, or ctx is canceled.
+func (m *LockManager) Flock(ctx context.Context,
+	ino uint64, owner uint64, typ LockType, wait bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fl := m.load(ino)
+	if _, ok := fl.flocks[owner]; ok {
+		delete(fl.flocks, owner)
+		m.notify(ino, fl)
+		fl = m.load(ino)
+	}
+	if typ == LockUnlock {
+		if len(fl.posix) == 0 && len(fl.flocks) == 0 {
+			delete(m.files, ino)
+		}
+		return nil
+	}
+
+	for {
+		conflict := false
+		for o, t := range fl.flocks {
+			if o != owner && (t == LockWrite || typ == LockWrite) {
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			fl.flocks[owner] = typ
+			return nil
+		}
+		if !wait {
+			return syscall.EWOULDBLOCK
+		}
+
+		released := fl.released
+		m.mu.Unlock()
+		err := waitRelease(ctx, released)
+		m.mu.Lock()
+		if err != nil {
+			return err
+		}
+		fl = m.load(ino)
+	}
+}
+
+// waitRelease waits for released to be closed. It returns syscall.EINTR if
+// ctx is canceled first.
+func waitRelease(ctx context.Context, released <-chan struct{}) error {
+	select {
+	case <-released:
+		return nil
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
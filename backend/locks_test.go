@@ -0,0 +1,224 @@
+package backend
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// posixLocks returns the POSIX locks of ino held by m
+func posixLocks(m *LockManager, ino uint64) []FileLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fl, ok := m.files[ino]
+	if !ok {
+		return nil
+	}
+	return append([]FileLock(nil), fl.posix...)
+}
+
+func mustSetlk(t *testing.T, m *LockManager, lk FileLock) {
+	t.Helper()
+	if err := m.Setlk(context.Background(), 1, &lk, false); err != nil {
+		t.Fatalf("Setlk(%+v): %v", lk, err)
+	}
+}
+
+func TestSetlkSplitAndMerge(t *testing.T) {
+	m := NewLockManager()
+	mustSetlk(t, m, FileLock{Type: LockWrite, Start: 0, End: 99, Owner: 1})
+
+	// Unlocking the middle of a lock splits it
+	mustSetlk(t, m, FileLock{Type: LockUnlock, Start: 10, End: 19, Owner: 1})
+	want := []FileLock{
+		{Type: LockWrite, Start: 0, End: 9, Owner: 1},
+		{Type: LockWrite, Start: 20, End: 99, Owner: 1},
+	}
+	if got := posixLocks(m, 1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after unlock: got %+v, want %+v", got, want)
+	}
+
+	// Locking the gap merges the adjacent locks of the same type
+	mustSetlk(t, m, FileLock{Type: LockWrite, Start: 10, End: 19, Owner: 1})
+	want = []FileLock{{Type: LockWrite, Start: 0, End: 99, Owner: 1}}
+	if got := posixLocks(m, 1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after relock: got %+v, want %+v", got, want)
+	}
+
+	// Downgrading the middle splits the lock in three
+	mustSetlk(t, m, FileLock{Type: LockRead, Start: 40, End: 59, Owner: 1})
+	want = []FileLock{
+		{Type: LockWrite, Start: 0, End: 39, Owner: 1},
+		{Type: LockWrite, Start: 60, End: 99, Owner: 1},
+		{Type: LockRead, Start: 40, End: 59, Owner: 1},
+	}
+	if got := posixLocks(m, 1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after downgrade: got %+v, want %+v", got, want)
+	}
+
+	// Unlocking everything forgets the file
+	mustSetlk(t, m,
+		FileLock{Type: LockUnlock, Start: 0, End: LockEOF, Owner: 1})
+	if got := posixLocks(m, 1); got != nil {
+		t.Fatalf("after unlock all: got %+v, want none", got)
+	}
+}
+
+func TestSetlkConflict(t *testing.T) {
+	m := NewLockManager()
+	ctx := context.Background()
+	mustSetlk(t, m, FileLock{Type: LockRead, Start: 0, End: 99, Owner: 1})
+
+	// Read locks are shared, write locks are not
+	mustSetlk(t, m, FileLock{Type: LockRead, Start: 50, End: 149, Owner: 2})
+	lk := FileLock{Type: LockWrite, Start: 90, End: LockEOF, Owner: 3}
+	if err := m.Setlk(ctx, 1, &lk, false); err != syscall.EAGAIN {
+		t.Fatalf("Setlk of conflicting lock: got %v, want EAGAIN", err)
+	}
+	if c := m.Getlk(1, &lk); c == nil || c.Owner == 3 {
+		t.Fatalf("Getlk: got %+v, want a lock of owner 1 or 2", c)
+	}
+
+	// Locks of the same owner never conflict
+	lk = FileLock{Type: LockWrite, Start: 100, End: 149, Owner: 2}
+	if c := m.Getlk(1, &lk); c != nil {
+		t.Fatalf("Getlk of own range: got %+v, want nil", c)
+	}
+	lk = FileLock{Type: LockWrite, Start: 150, End: LockEOF, Owner: 3}
+	if c := m.Getlk(1, &lk); c != nil {
+		t.Fatalf("Getlk of free range: got %+v, want nil", c)
+	}
+
+	lk = FileLock{Type: LockRead, Start: 10, End: 5, Owner: 3}
+	if err := m.Setlk(ctx, 1, &lk, false); err != syscall.EINVAL {
+		t.Fatalf("Setlk of empty range: got %v, want EINVAL", err)
+	}
+}
+
+// setlkAsync places lk waiting for it in the background, and returns the
+// channel of the result
+func setlkAsync(
+	ctx context.Context, m *LockManager, lk FileLock) <-chan error {
+	res := make(chan error, 1)
+	go func() {
+		res <- m.Setlk(ctx, 1, &lk, true)
+	}()
+	return res
+}
+
+// waitBlocked waits until owner is blocked on a lock of m
+func waitBlocked(t *testing.T, m *LockManager, owner uint64) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		m.mu.Lock()
+		_, ok := m.waitsFor[owner]
+		m.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("owner %v does not wait", owner)
+}
+
+func TestSetlkWakeup(t *testing.T) {
+	m := NewLockManager()
+	mustSetlk(t, m, FileLock{Type: LockWrite, Start: 0, End: 9, Owner: 1})
+
+	res := setlkAsync(context.Background(), m,
+		FileLock{Type: LockWrite, Start: 5, End: 14, Owner: 2})
+	waitBlocked(t, m, 2)
+	select {
+	case err := <-res:
+		t.Fatalf("Setlk returned %v while the lock is held", err)
+	default:
+	}
+
+	mustSetlk(t, m, FileLock{Type: LockUnlock, Start: 0, End: 9, Owner: 1})
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Fatalf("Setlk after release: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Setlk is not woken up by the release")
+	}
+}
+
+func TestSetlkDeadlock(t *testing.T) {
+	m := NewLockManager()
+	mustSetlk(t, m, FileLock{Type: LockWrite, Start: 0, End: 0, Owner: 1})
+	mustSetlk(t, m, FileLock{Type: LockWrite, Start: 1, End: 1, Owner: 2})
+
+	// Owner 1 waits for owner 2, so owner 2 waiting for owner 1 deadlocks
+	res := setlkAsync(context.Background(), m,
+		FileLock{Type: LockWrite, Start: 1, End: 1, Owner: 1})
+	waitBlocked(t, m, 1)
+	lk := FileLock{Type: LockWrite, Start: 0, End: 0, Owner: 2}
+	err := m.Setlk(context.Background(), 1, &lk, true)
+	if err != syscall.EDEADLK {
+		t.Fatalf("Setlk closing a cycle: got %v, want EDEADLK", err)
+	}
+
+	mustSetlk(t, m, FileLock{Type: LockUnlock, Start: 1, End: 1, Owner: 2})
+	if err := <-res; err != nil {
+		t.Fatalf("Setlk after release: %v", err)
+	}
+}
+
+func TestSetlkInterrupt(t *testing.T) {
+	m := NewLockManager()
+	mustSetlk(t, m, FileLock{Type: LockWrite, Start: 0, End: LockEOF, Owner: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := setlkAsync(ctx, m,
+		FileLock{Type: LockRead, Start: 0, End: 0, Owner: 2})
+	waitBlocked(t, m, 2)
+	cancel()
+	if err := <-res; err != syscall.EINTR {
+		t.Fatalf("Setlk canceled: got %v, want EINTR", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.waitsFor[2]; ok {
+		t.Fatal("owner 2 still waits after Setlk is canceled")
+	}
+}
+
+func TestFlock(t *testing.T) {
+	m := NewLockManager()
+	ctx := context.Background()
+	if err := m.Flock(ctx, 1, 1, LockRead, false); err != nil {
+		t.Fatalf("Flock shared: %v", err)
+	}
+	if err := m.Flock(ctx, 1, 2, LockRead, false); err != nil {
+		t.Fatalf("Flock shared by another owner: %v", err)
+	}
+	if err := m.Flock(ctx, 1, 3, LockWrite, false); err != syscall.EWOULDBLOCK {
+		t.Fatalf("Flock exclusive: got %v, want EWOULDBLOCK", err)
+	}
+
+	// BSD locks and POSIX locks do not conflict
+	mustSetlk(t, m, FileLock{Type: LockWrite, Start: 0, End: LockEOF, Owner: 3})
+
+	res := make(chan error, 1)
+	go func() {
+		res <- m.Flock(ctx, 1, 3, LockWrite, true)
+	}()
+	for _, owner := range []uint64{1, 2} {
+		if err := m.Flock(ctx, 1, owner, LockUnlock, false); err != nil {
+			t.Fatalf("Flock unlock: %v", err)
+		}
+	}
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Fatalf("Flock after release: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flock is not woken up by the release")
+	}
+}
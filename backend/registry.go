@@ -0,0 +1,272 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OptionType is the type of the value of a backend option
+type OptionType int
+
+const (
+	OptionString   OptionType = iota // Any string, or one of Option.Choices
+	OptionBool                       // true or false, "key" alone is true
+	OptionUint                       // Unsigned integer
+	OptionSize                       // Bytes, with an optional K, M, G or T
+	OptionDuration                   // Duration such as "1m30s"
+)
+
+var optionTypeNames = []string{"string", "bool", "uint", "size", "duration"}
+
+func (t OptionType) String() string {
+	if t < 0 || int(t) >= len(optionTypeNames) {
+		return fmt.Sprintf("OptionType(%d)", int(t))
+	}
+	return optionTypeNames[t]
+}
+
+// Option declares an option of a backend, which is given at mount as
+// key=value
+type Option struct {
+	Name        string
+	Type        OptionType
+	Description string
+
+	// Value of the option if it is not given, parsed as a given value.
+	// An empty default is the zero value of Type.
+	Default string
+
+	// Values allowed for an OptionString option, any if empty
+	Choices []string
+}
+
+// parse parses value of the option
+func (o *Option) parse(value string) (interface{}, error) {
+	switch o.Type {
+	case OptionString:
+		if len(o.Choices) == 0 {
+			return value, nil
+		}
+		for _, c := range o.Choices {
+			if value == c {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("option %s: %q is not one of %s",
+			o.Name, value, strings.Join(o.Choices, ", "))
+	case OptionBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("option %s: %q is not a bool", o.Name, value)
+		}
+		return b, nil
+	case OptionUint:
+		n, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"option %s: %q is not an unsigned integer", o.Name, value)
+		}
+		return n, nil
+	case OptionSize:
+		n, err := parseSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("option %s: %q is not a size", o.Name, value)
+		}
+		return n, nil
+	case OptionDuration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"option %s: %q is not a duration", o.Name, value)
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("option %s: unknown type %v", o.Name, o.Type)
+}
+
+// zero returns the zero value of the option
+func (o *Option) zero() interface{} {
+	switch o.Type {
+	case OptionBool:
+		return false
+	case OptionUint, OptionSize:
+		return uint64(0)
+	case OptionDuration:
+		return time.Duration(0)
+	}
+	return ""
+}
+
+// parseSize parses a number of bytes with an optional binary suffix, such as
+// "4G" for 4 GiB
+func parseSize(s string) (uint64, error) {
+	shift := uint(0)
+	if i := len(s) - 1; i > 0 {
+		switch s[i] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		case 't', 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:i]
+		}
+	}
+	n, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > (^uint64(0))>>shift {
+		return 0, strconv.ErrRange
+	}
+	return n << shift, nil
+}
+
+// Options holds the values of the options of a backend, which are parsed and
+// checked against the declared options, so a backend reads them by type
+type Options struct {
+	values map[string]interface{}
+}
+
+// value returns the value of the option name. It panics if the backend does
+// not declare the option, which is a bug of the backend. So do the typed
+// getters if the option is of another type.
+func (o *Options) value(name string) interface{} {
+	v, ok := o.values[name]
+	if !ok {
+		panic(fmt.Sprintf("backend option %s is not declared", name))
+	}
+	return v
+}
+
+// String returns the value of an OptionString option
+func (o *Options) String(name string) string {
+	return o.value(name).(string)
+}
+
+// Bool returns the value of an OptionBool option
+func (o *Options) Bool(name string) bool {
+	return o.value(name).(bool)
+}
+
+// Uint returns the value of an OptionUint or OptionSize option
+func (o *Options) Uint(name string) uint64 {
+	return o.value(name).(uint64)
+}
+
+// Duration returns the value of an OptionDuration option
+func (o *Options) Duration(name string) time.Duration {
+	return o.value(name).(time.Duration)
+}
+
+// Backend describes a kind of backend, which is selected by its name at mount
+type Backend struct {
+	Name        string
+	Description string
+	Options     []Option
+
+	// New creates a backend with options, which are parsed from Options
+	New func(opts *Options) (BackendFS, error)
+}
+
+// option returns the declared option name, or nil
+func (b *Backend) option(name string) *Option {
+	for i := range b.Options {
+		if b.Options[i].Name == name {
+			return &b.Options[i]
+		}
+	}
+	return nil
+}
+
+// ParseOptions parses options given as "key=value" or "key" (for
+// OptionBool options) against the options of the backend. Options not
+// given take their default values.
+func (b *Backend) ParseOptions(args []string) (*Options, error) {
+	opts := &Options{values: make(map[string]interface{})}
+	for i := range b.Options {
+		o := &b.Options[i]
+		if o.Default == "" {
+			opts.values[o.Name] = o.zero()
+			continue
+		}
+		v, err := o.parse(o.Default)
+		if err != nil {
+			return nil, fmt.Errorf("%s: default of %v", b.Name, err)
+		}
+		opts.values[o.Name] = v
+	}
+
+	for _, arg := range args {
+		key, value := arg, ""
+		i := strings.IndexByte(arg, '=')
+		if i >= 0 {
+			key, value = arg[:i], arg[i+1:]
+		}
+		o := b.option(key)
+		if o == nil {
+			return nil, fmt.Errorf("%s: unknown option %s", b.Name, key)
+		}
+		if i < 0 {
+			if o.Type != OptionBool {
+				return nil, fmt.Errorf(
+					"%s: option %s needs a value", b.Name, key)
+			}
+			value = "true"
+		}
+		v, err := o.parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name, err)
+		}
+		opts.values[key] = v
+	}
+	return opts, nil
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Backend)
+)
+
+// Register makes a backend available by its name. It is usually called from
+// the init function of the package implementing the backend, so importing
+// the package registers it. Register panics if the name is registered twice.
+func Register(b *Backend) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if b == nil || b.New == nil {
+		panic("backend: Register of a backend without New")
+	}
+	if _, dup := registry[b.Name]; dup {
+		panic("backend: Register called twice for backend " + b.Name)
+	}
+	registry[b.Name] = b
+}
+
+// Lookup returns the backend registered as name
+func Lookup(name string) (*Backend, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	b, ok := registry[name]
+	return b, ok
+}
+
+// Backends returns the backends registered, sorted by name
+func Backends() []*Backend {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	res := make([]*Backend, 0, len(registry))
+	for _, b := range registry {
+		res = append(res, b)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+var testBackend = Backend{
+	Name: "test",
+	Options: []Option{{
+		Name: "name",
+		Type: OptionString,
+	}, {
+		Name:    "mode",
+		Type:    OptionString,
+		Default: "fast",
+		Choices: []string{"fast", "safe"},
+	}, {
+		Name: "verbose",
+		Type: OptionBool,
+	}, {
+		Name:    "count",
+		Type:    OptionUint,
+		Default: "10",
+	}, {
+		Name:    "size",
+		Type:    OptionSize,
+		Default: "1K",
+	}, {
+		Name: "timeout",
+		Type: OptionDuration,
+	}},
+}
+
+func TestParseOptionsDefaults(t *testing.T) {
+	opts, err := testBackend.ParseOptions(nil)
+	if err != nil {
+		t.Fatalf("ParseOptions: %v", err)
+	}
+	if v := opts.String("name"); v != "" {
+		t.Errorf("name: got %q, want empty", v)
+	}
+	if v := opts.String("mode"); v != "fast" {
+		t.Errorf("mode: got %q, want fast", v)
+	}
+	if v := opts.Bool("verbose"); v {
+		t.Errorf("verbose: got %v, want false", v)
+	}
+	if v := opts.Uint("count"); v != 10 {
+		t.Errorf("count: got %v, want 10", v)
+	}
+	if v := opts.Uint("size"); v != 1024 {
+		t.Errorf("size: got %v, want 1024", v)
+	}
+	if v := opts.Duration("timeout"); v != 0 {
+		t.Errorf("timeout: got %v, want 0", v)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := testBackend.ParseOptions([]string{"name=a=b", "mode=safe",
+		"verbose", "count=0x20", "size=2m", "timeout=1m30s"})
+	if err != nil {
+		t.Fatalf("ParseOptions: %v", err)
+	}
+	if v := opts.String("name"); v != "a=b" {
+		t.Errorf("name: got %q, want a=b", v)
+	}
+	if v := opts.String("mode"); v != "safe" {
+		t.Errorf("mode: got %q, want safe", v)
+	}
+	if v := opts.Bool("verbose"); !v {
+		t.Errorf("verbose: got %v, want true", v)
+	}
+	if v := opts.Uint("count"); v != 32 {
+		t.Errorf("count: got %v, want 32", v)
+	}
+	if v := opts.Uint("size"); v != 2<<20 {
+		t.Errorf("size: got %v, want %v", v, 2<<20)
+	}
+	if v := opts.Duration("timeout"); v != 90*time.Second {
+		t.Errorf("timeout: got %v, want 1m30s", v)
+	}
+
+	// The last value given wins
+	opts, err = testBackend.ParseOptions([]string{"verbose", "verbose=false"})
+	if err != nil {
+		t.Fatalf("ParseOptions: %v", err)
+	}
+	if v := opts.Bool("verbose"); v {
+		t.Errorf("verbose given twice: got %v, want false", v)
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"unknown=1"},
+		{"unknown"},
+		{"name"},          // Not a bool, needs a value
+		{"count"},         // Not a bool, needs a value
+		{"mode=slow"},     // Not one of the choices
+		{"verbose=maybe"}, // Not a bool
+		{"count=-1"},
+		{"count=ten"},
+		{"size=1X"},
+		{"timeout=10"}, // No unit
+	} {
+		if _, err := testBackend.ParseOptions(args); err == nil {
+			t.Errorf("ParseOptions(%q) succeeds, want an error", args)
+		}
+	}
+
+	b := Backend{
+		Name:    "bad",
+		Options: []Option{{Name: "count", Type: OptionUint, Default: "x"}},
+	}
+	if _, err := b.ParseOptions(nil); err == nil {
+		t.Error("ParseOptions with a bad default succeeds, want an error")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want uint64
+	}{
+		{"0", 0},
+		{"4096", 4096},
+		{"0x10", 16},
+		{"1k", 1 << 10},
+		{"1K", 1 << 10},
+		{"3m", 3 << 20},
+		{"3M", 3 << 20},
+		{"4g", 4 << 30},
+		{"4G", 4 << 30},
+		{"2t", 2 << 40},
+		{"2T", 2 << 40},
+		{"16777215T", 16777215 << 40},
+		{"18446744073709551615", 1<<64 - 1},
+	} {
+		got, err := parseSize(tc.s)
+		if err != nil || got != tc.want {
+			t.Errorf("parseSize(%q): got %v, %v, want %v",
+				tc.s, got, err, tc.want)
+		}
+	}
+
+	for _, s := range []string{
+		"", "K", "-1", "1.5G", "1KB", "1P", " 1", "16777216T",
+		"18446744073709551616",
+	} {
+		if got, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q): got %v, want an error", s, got)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Package fusefs serves a backend.BackendFS over FUSE with bazil.org/fuse.
+// It translates FUSE requests to calls of the backend, checks permissions
+// unless the kernel does, and keeps the kernel caches coherent.
+package fusefs
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"fused/backend"
+)
+
+// FS implements:
+//   fs.FS
+//   fs.FSStatfser
+//   fs.FSInodeGenerator
+//   fs.FSDestroyer
+type FS struct {
+	Back backend.BackendFS // backing filesystem
+
+	// If set, permission checking is delegated to the kernel, which requires
+	// the filesystem to be mounted with the default_permissions option.
+	// Otherwise, FuseNode checks permissions against the requester.
+	DefaultPermissions bool
+
+	// How the kernel caches the filesystem. It should be set before the
+	// filesystem is served. Note that names made by MKDIR, MKNOD, SYMLINK
+	// and LINK are cached for the FUSE library's default of a minute, as
+	// the library has no way to set it for these requests.
+	Cache backend.CacheConfig
+
+	// Attributes reported for every file in place of those of the backend
+	Override AttrOverride
+
+	mu sync.Mutex // lock guarding nodeMap and handles
+
+	// Ino -> FuseNode mapping. The mapping is necessary because the FUSE
+	// library uses fs.Node (FuseNode here) as a map key. Methods that return
+	// fs.Node should return the same fs.Node when the result is logically
+	// the same instance, otherwise unexpected behavior may happen.
+	// An inode number reused by the backend with a new generation is mapped
+	// to a new FuseNode, for which the library assigns a new node ID and
+	// generation, so the kernel never takes it for the old inode.
+	// Note that inodes cannot be looked up by inode and generation numbers.
+	// bazil.org/fuse does not enable FUSE_EXPORT_SUPPORT, so the kernel
+	// resolves file handles of NFS and open_by_handle_at(2) only while it
+	// caches the inode, and fails with ESTALE otherwise.
+	nodeMap map[uint64]*FuseNode
+
+	// Handles being opened by the response to OPEN or CREATE, to which the
+	// library has not assigned an ID yet
+	handles map[*fuse.OpenResponse]*FuseHandle
+
+	// Last lock owner assigned to a FuseHandle, accessed atomically
+	lockOwner uint64
+
+	closeOnce sync.Once
+	closeErr  error // Error of closing the backend
+}
+
+// AttrOverride overrides the owner and permissions reported to the kernel,
+// like the uid, gid and umask mount options of libfuse. The backend keeps its
+// attributes, which FuseNode checks permissions against; the kernel checks
+// the reported ones instead if DefaultPermissions is set.
+type AttrOverride struct {
+	SetUID   bool
+	UID      uint32
+	SetGID   bool
+	GID      uint32
+	SetUmask bool
+	Umask    os.FileMode // Permission bits cleared from every file
+}
+
+// apply overrides attributes of attr
+func (o *AttrOverride) apply(attr *fuse.Attr) {
+	if o.SetUID {
+		attr.Uid = o.UID
+	}
+	if o.SetGID {
+		attr.Gid = o.GID
+	}
+	if o.SetUmask {
+		attr.Mode &^= o.Umask & os.ModePerm
+	}
+}
+
+// This is a compile-time assertion to ensure that FS implements
+// fs.FSInodeGenerator interface
+var _ fs.FSInodeGenerator = (*FS)(nil)
+
+// NewFS returns a filesystem serving back, which the kernel caches as back
+// advises if it implements backend.CacheAdviser
+func NewFS(back backend.BackendFS) *FS {
+	cache := backend.DefaultCacheConfig
+	if adviser, ok := back.(backend.CacheAdviser); ok {
+		cache = adviser.CacheConfig()
+	}
+	return &FS{Back: back, Cache: cache}
+}
+
+// openFlags returns the flags of a response to opening a file or directory,
+// as set by s.Cache
+func (s *FS) openFlags(dir bool) fuse.OpenResponseFlags {
+	var flags fuse.OpenResponseFlags
+	if dir {
+		return flags
+	}
+	if s.Cache.KeepCache {
+		flags |= fuse.OpenKeepCache
+	}
+	if s.Cache.DirectIO {
+		flags |= fuse.OpenDirectIO
+	}
+	return flags
+}
+
+// openBackendFlags returns the flags to open a file with on the backend,
+// which are also the flags of its FuseHandle. Permissions are checked against
+// the flags requested instead.
+func (s *FS) openBackendFlags(flags fuse.OpenFlags) int {
+	if s.Cache.WritebackCache {
+		// The kernel appends to files by itself, and writes sent with
+		// O_APPEND have the offsets to write at
+		flags &^= fuse.OpenAppend
+		// The kernel reads pages of a file via any handle to fill them before
+		// writing parts of them, so a write-only file is readable, as with
+		// libfuse
+		if flags&fuse.OpenAccessModeMask == fuse.OpenWriteOnly {
+			flags = flags&^fuse.OpenAccessModeMask | fuse.OpenReadWrite
+		}
+	}
+	return int(flags)
+}
+
+// Serve serves the filesystem on connection c until it is unmounted. If the
+// backend implements backend.Notifier, the changes it reports are passed on
+// to the kernel, which invalidates its caches.
+func (s *FS) Serve(c *fuse.Conn) error {
+	srv := fs.New(c, &fs.Config{Debug: s.debug, WithContext: withCaller})
+	if n, ok := s.Back.(backend.Notifier); ok {
+		done := make(chan struct{})
+		defer close(done)
+		go s.invalidate(srv, n.Changes(), done)
+	}
+	return srv.Serve(s)
+}
+
+// debug logs msg as fuse.Debug does. The library passes it the responses to
+// OPEN and CREATE after assigning the handle ID and before replying to the
+// kernel, which is the only way to learn the ID of a handle before requests
+// on the handle arrive. Messages are made of exported fields, as they are
+// marshaled to JSON.
+func (s *FS) debug(msg interface{}) {
+	if v := reflect.ValueOf(msg); v.Kind() == reflect.Struct {
+		// A response is logged in field Out
+		if out := v.FieldByName("Out"); out.IsValid() && out.CanInterface() {
+			switch resp := out.Interface().(type) {
+			case *fuse.OpenResponse:
+				s.opened(resp)
+			case *fuse.CreateResponse:
+				s.opened(&resp.OpenResponse)
+			}
+		}
+	}
+	fuse.Debug(msg)
+}
+
+// opening registers fh, which is opened by resp, to learn its ID
+func (s *FS) opening(resp *fuse.OpenResponse, fh *FuseHandle) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handles == nil {
+		s.handles = make(map[*fuse.OpenResponse]*FuseHandle)
+	}
+	s.handles[resp] = fh
+}
+
+// opened records the ID the library assigns to the handle opened by resp
+func (s *FS) opened(resp *fuse.OpenResponse) {
+	s.mu.Lock()
+	fh, ok := s.handles[resp]
+	delete(s.handles, resp)
+	s.mu.Unlock()
+	if ok {
+		fh.setID(resp.Handle)
+	}
+}
+
+// withCaller returns a context of request req, which carries the caller of
+// the request to the backend. The library cancels the context when the
+// request is interrupted.
+func withCaller(ctx context.Context, req fuse.Request) context.Context {
+	h := req.Hdr()
+	return backend.WithCaller(ctx,
+		backend.Caller{UID: h.Uid, GID: h.Gid, PID: h.Pid})
+}
+
+// invalidator invalidates caches of the kernel, which fs.Server implements
+type invalidator interface {
+	InvalidateNodeDataRange(node fs.Node, off int64, size int64) error
+	InvalidateNodeAttr(node fs.Node) error
+	InvalidateEntry(parent fs.Node, name string) error
+}
+
+// invalidate invalidates caches of the kernel for changes, until changes is
+// closed or done is closed
+func (s *FS) invalidate(
+	srv invalidator, changes <-chan backend.Change, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			s.applyChange(srv, &change)
+		}
+	}
+}
+
+func (s *FS) applyChange(srv invalidator, change *backend.Change) {
+	log.Printf("Change %v: Kind %v, Name %s, Offset %v, Length %v",
+		change.Ino, change.Kind, change.Name, change.Offset, change.Length)
+	s.mu.Lock()
+	n, ok := s.nodeMap[change.Ino]
+	s.mu.Unlock()
+	if !ok {
+		// The kernel caches nothing of inodes it does not know
+		return
+	}
+
+	var err error
+	switch change.Kind {
+	case backend.ChangeData, backend.ChangeAttr:
+		// The change is not made by a request, so it has no caller
+		ctx := context.Background()
+		if stat, err := s.Back.Stat(ctx, change.Ino); err == nil {
+			s.mu.Lock()
+			n.update(stat)
+			s.mu.Unlock()
+		}
+		if change.Kind == backend.ChangeData {
+			err = srv.InvalidateNodeDataRange(n, change.Offset, change.Length)
+		} else {
+			err = srv.InvalidateNodeAttr(n)
+		}
+	case backend.ChangeEntry:
+		err = srv.InvalidateEntry(n, change.Name)
+	}
+	if err != nil && err != fuse.ErrNotCached {
+		log.Printf("Invalidating %v: %v", change.Ino, err)
+	}
+}
+
+// Destroy is called by the FUSE library when the filesystem is unmounted.
+// Note that Linux only sends DESTROY to filesystems mounted as fuseblk, so
+// Serve's caller should call Close as well.
+func (s *FS) Destroy() {
+	log.Println("Destroy")
+	if err := s.Close(); err != nil {
+		log.Printf("Closing backend: %v", err)
+	}
+}
+
+// Close closes the backend, which flushes its state and releases its
+// resources. The backend is closed only once however many times Close is
+// called.
+func (s *FS) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.Back.Close()
+	})
+	return s.closeErr
+}
+
+func (s *FS) Root() (fs.Node, error) {
+	return s.loadNode(1, nil), nil
+}
+
+func (s *FS) Statfs(
+	ctx context.Context,
+	_ *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	st, err := s.Back.Statfs(ctx)
+	if err != nil {
+		return FuseError(err)
+	}
+	// Total data blocks in filesystem
+	resp.Blocks = st.Blocks
+	// Free blocks in filesystem
+	resp.Bfree = st.Bfree
+	// Free blocks available to unprivileged user (non-superuser)
+	resp.Bavail = st.Bavail
+	// Total file nodes in filesystem
+	resp.Files = st.Files
+	// Free file nodes in filesystem
+	resp.Ffree = st.Ffree
+	resp.Bsize = st.Bsize
+	// Maximum length of filenames
+	resp.Namelen = st.Namelen
+	// Fragment size (since Linux 2.6), the unit of block counts
+	resp.Frsize = st.Bsize
+
+	return nil
+}
+
+// GenerateInode is called by the FUSE library to pick an inode number for a
+// node whose inode number is 0. Backends always number their inodes, so this
+// should never happen.
+func (s *FS) GenerateInode(parentInode uint64, name string) uint64 {
+	log.Printf("Warning: inode number of <%v, %s> is 0", parentInode, name)
+	return fs.GenerateDynamicInode(parentInode, name)
+}
+
+// loadNode returns the node of inode ino, which is created unless ino is
+// mapped to a node of the same generation already. The attributes of the
+// node are updated to stat unless it is nil.
+func (s *FS) loadNode(ino uint64, stat *backend.Stat) *FuseNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nodeMap == nil {
+		s.nodeMap = make(map[uint64]*FuseNode)
+	}
+	n, ok := s.nodeMap[ino]
+	if !ok || (stat != nil && n.generation != stat.Generation) {
+		n = newFuseNode(s, ino, stat)
+		s.nodeMap[ino] = n
+	}
+	n.update(stat)
+	return n
+}
+
+// newLockOwner returns a lock owner that is unique within the filesystem
+func (s *FS) newLockOwner() uint64 {
+	return atomic.AddUint64(&s.lockOwner, 1)
+}
+
+// removeNode removes node n forgotten by the kernel, unless the inode number
+// is mapped to another node already
+func (s *FS) removeNode(n *FuseNode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nodeMap[n.ino] == n {
+		delete(s.nodeMap, n.ino)
+	}
+}
@@ -0,0 +1,196 @@
+package fusefs
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"fused/backend"
+	"fused/memfs"
+)
+
+func TestLoadNodeGeneration(t *testing.T) {
+	back := memfs.NewMemFS()
+	s := NewFS(back)
+	ctx := context.Background()
+
+	stat, fh, err := back.Create(ctx, 1, "a", syscall.O_RDWR, 0644, 0, 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	n := s.loadNode(stat.Ino, stat)
+	if got := s.loadNode(stat.Ino, stat); got != n {
+		t.Errorf("same inode: got %p, want %p", got, n)
+	}
+	if got := s.loadNode(stat.Ino, nil); got != n {
+		t.Errorf("inode without attributes: got %p, want %p", got, n)
+	}
+
+	// Remove the file, so that the next file reuses its inode number
+	if err := back.Unlink(ctx, 1, "a"); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+	if err := back.Release(ctx, stat.Ino, fh, syscall.O_RDWR); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	reused, _, err := back.Create(ctx, 1, "b", syscall.O_RDWR, 0644, 0, 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if reused.Ino != stat.Ino || reused.Generation == stat.Generation {
+		t.Fatalf("inode <%v, %v> does not reuse <%v, %v>",
+			reused.Ino, reused.Generation, stat.Ino, stat.Generation)
+	}
+
+	m := s.loadNode(reused.Ino, reused)
+	if m == n {
+		t.Fatalf("inode reused with new generation is loaded as old node")
+	}
+	if m.generation != reused.Generation {
+		t.Errorf("generation: got %v, want %v",
+			m.generation, reused.Generation)
+	}
+	if got := s.loadNode(reused.Ino, nil); got != m {
+		t.Errorf("reused inode without attributes: got %p, want %p", got, m)
+	}
+
+	// Forgetting the old node keeps the new one
+	s.removeNode(n)
+	if got := s.loadNode(reused.Ino, nil); got != m {
+		t.Errorf("after forgetting old node: got %p, want %p", got, m)
+	}
+}
+
+// notifyingFS is a backend reporting the changes sent to it
+type notifyingFS struct {
+	*memfs.MemFS
+	changes chan backend.Change
+}
+
+func (b *notifyingFS) Changes() <-chan backend.Change {
+	return b.changes
+}
+
+var _ backend.Notifier = (*notifyingFS)(nil)
+
+// invalidation is a call of invalidator
+type invalidation struct {
+	op        string
+	node      fs.Node
+	name      string
+	off, size int64
+}
+
+// fakeServer records invalidations, which fail with err
+type fakeServer struct {
+	calls []invalidation
+	err   error
+}
+
+func (srv *fakeServer) InvalidateNodeDataRange(
+	node fs.Node, off int64, size int64) error {
+	srv.calls = append(srv.calls,
+		invalidation{op: "data", node: node, off: off, size: size})
+	return srv.err
+}
+
+func (srv *fakeServer) InvalidateNodeAttr(node fs.Node) error {
+	srv.calls = append(srv.calls, invalidation{op: "attr", node: node})
+	return srv.err
+}
+
+func (srv *fakeServer) InvalidateEntry(parent fs.Node, name string) error {
+	srv.calls = append(srv.calls,
+		invalidation{op: "entry", node: parent, name: name})
+	return srv.err
+}
+
+func TestInvalidate(t *testing.T) {
+	back := &notifyingFS{memfs.NewMemFS(), make(chan backend.Change)}
+	s := NewFS(back)
+	ctx := context.Background()
+	stat, fh, err := back.Create(ctx, 1, "a", syscall.O_RDWR, 0644, 0, 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	root := s.loadNode(1, nil)
+	n := s.loadNode(stat.Ino, stat)
+
+	srv := &fakeServer{}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		s.invalidate(srv, back.Changes(), done)
+		close(finished)
+	}()
+
+	// The file is written by others than the mount
+	if _, err := back.Write(ctx, stat.Ino, fh, 0, []byte("data")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	back.changes <- backend.Change{
+		Kind: backend.ChangeData, Ino: stat.Ino, Offset: 0, Length: 4}
+	back.changes <- backend.Change{Kind: backend.ChangeAttr, Ino: stat.Ino}
+	back.changes <- backend.Change{Kind: backend.ChangeEntry, Ino: 1, Name: "b"}
+	// The kernel caches nothing of inodes without a node
+	back.changes <- backend.Change{Kind: backend.ChangeAttr, Ino: stat.Ino + 1}
+	close(back.changes)
+	<-finished
+
+	want := []invalidation{
+		{op: "data", node: n, off: 0, size: 4},
+		{op: "attr", node: n},
+		{op: "entry", node: root, name: "b"},
+	}
+	if !reflect.DeepEqual(srv.calls, want) {
+		t.Errorf("invalidations: got %+v, want %+v", srv.calls, want)
+	}
+	// Attributes of the node are refreshed from the backend
+	if n.attr.Size != 4 {
+		t.Errorf("size of node: got %v, want 4", n.attr.Size)
+	}
+
+	// Closing done stops invalidating while changes are still open
+	changes := make(chan backend.Change)
+	finished = make(chan struct{})
+	go func() {
+		s.invalidate(srv, changes, done)
+		close(finished)
+	}()
+	close(done)
+	<-finished
+}
+
+func TestInvalidateNotCached(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	s := NewFS(memfs.NewMemFS())
+	s.loadNode(1, nil)
+	change := &backend.Change{Kind: backend.ChangeEntry, Ino: 1, Name: "a"}
+
+	// Invalidating what the kernel does not cache is no error
+	srv := &fakeServer{err: fuse.ErrNotCached}
+	s.applyChange(srv, change)
+	if strings.Contains(buf.String(), "Invalidating") {
+		t.Errorf("ErrNotCached is logged: %s", buf.String())
+	}
+
+	srv.err = syscall.EIO
+	s.applyChange(srv, change)
+	if !strings.Contains(buf.String(), "Invalidating 1: ") {
+		t.Errorf("error is not logged: %s", buf.String())
+	}
+	if len(srv.calls) != 2 {
+		t.Errorf("%v invalidations, want 2", len(srv.calls))
+	}
+}
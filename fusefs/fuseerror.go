@@ -1,4 +1,4 @@
-package main
+package fusefs
 
 import (
 	//"log"
@@ -21,6 +21,10 @@ func FuseError(err error) error {
 		return e
 	}
 	if e, ok := err.(syscall.Errno); ok {
+		if e == syscall.ENODATA {
+			// ENOATTR on OS X
+			return fuse.ErrNoXattr
+		}
 		return fuse.Errno(e)
 	}
 	return fuse.EIO
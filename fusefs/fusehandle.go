@@ -0,0 +1,410 @@
+package fusefs
+
+import (
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"fused/backend"
+)
+
+// FuseHandle implements:
+//   fuse.HandleReader (also for reading directories)
+//   fuse.HandleWriter
+//   fuse.HandleFlusher
+//   fuse.HandleReleaser
+//   fuse.HandlePOSIXLocker
+//   fuse.HandleFlockLocker
+//   fuse.HandleFAllocater
+//
+// fuse.HandleReadAller is not implemented, since reading a whole sparse file
+// into memory may take much more space than the file.
+type FuseHandle struct {
+	fs     *FS
+	ino    uint64
+	node   *FuseNode
+	handle backend.HandleID // Handle of the open file in backend
+	flags  int              // Access mode of open flags
+
+	// Owner of BSD locks placed via this handle. As with flock(2), BSD locks
+	// are associated with an open file.
+	owner uint64
+
+	mu sync.Mutex // Lock protecting the following fields
+
+	// ID of the handle in FUSE requests, which the library assigns once the
+	// handle is opened, see FS.debug. The kernel learns it from the reply,
+	// so it is known before any request on the handle arrives.
+	id      fuse.HandleID
+	idKnown bool
+
+	// Readdir markers that cannot be used as offsets directly. The offset
+	// of markers[i] is readdirTableOffset | (i + 1).
+	markers []string
+}
+
+// These are compile-time assertions to ensure that FuseHandle implements the
+// optional interfaces, which the library checks for at run time
+var (
+	_ fs.HandlePOSIXLocker = (*FuseHandle)(nil)
+	_ fs.HandleFlockLocker = (*FuseHandle)(nil)
+	_ fs.HandleFAllocater  = (*FuseHandle)(nil)
+)
+
+// Readdir offsets with this bit set are indexes into FuseHandle.markers
+const readdirTableOffset = 1 << 63
+
+// newFuseHandle returns the handle of node opened as handle in backend,
+// which is replied to the kernel with resp
+func newFuseHandle(node *FuseNode, handle backend.HandleID, flags int,
+	resp *fuse.OpenResponse) *FuseHandle {
+	fh := &FuseHandle{
+		fs:     node.fs,
+		ino:    node.ino,
+		node:   node,
+		handle: handle,
+		flags:  flags & syscall.O_ACCMODE,
+		owner:  node.fs.newLockOwner(),
+	}
+	node.addHandle(fh)
+	node.fs.opening(resp, fh)
+	return fh
+}
+
+// setID records the ID of the handle in FUSE requests
+func (fh *FuseHandle) setID(id fuse.HandleID) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	fh.id, fh.idKnown = id, true
+}
+
+// hasID reports whether the handle has ID id in FUSE requests
+func (fh *FuseHandle) hasID(id fuse.HandleID) bool {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	return fh.idKnown && fh.id == id
+}
+
+func (fh *FuseHandle) Read(
+	ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	log.Printf(
+		"Read %v: Offset %v, Size %v", fh.ino, req.Offset, req.Size)
+	if req.Dir {
+		return fh.readDir(ctx, req, resp)
+	}
+	if fh.flags == syscall.O_WRONLY {
+		return FuseError(syscall.EBADF)
+	}
+	b, err := fh.fs.Back.Read(ctx, fh.ino, fh.handle, req.Offset, req.Size)
+	if err != nil && err != io.EOF {
+		return FuseError(err)
+	}
+	resp.Data = b
+	return nil
+}
+
+func (fh *FuseHandle) Write(
+	ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	log.Printf(
+		"Write %v: Size %v Offset %v", fh.ino, len(req.Data), req.Offset)
+	// The writer may be any process sharing the open file, or the kernel
+	// itself, so only the access mode of the open file is checked
+	if fh.flags == syscall.O_RDONLY {
+		return FuseError(syscall.EBADF)
+	}
+	n, err := fh.fs.Back.Write(ctx, fh.ino, fh.handle, req.Offset, req.Data)
+	if err != nil {
+		return FuseError(err)
+	}
+	resp.Size = n
+	return nil
+}
+
+func (fh *FuseHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	log.Println("Flush", fh.ino, req.LockOwner)
+	// POSIX record locks held by a process are released when it closes any
+	// file descriptor referring to the file
+	err := fh.fs.Back.Setlk(ctx, fh.ino, &backend.FileLock{
+		Type:  backend.LockUnlock,
+		Start: 0,
+		End:   backend.LockEOF,
+		Owner: uint64(req.LockOwner),
+	}, false)
+	if err != nil {
+		return FuseError(err)
+	}
+	return FuseError(fh.fs.Back.Flush(ctx, fh.ino, fh.handle))
+}
+
+// FAllocate manipulates the space allocated to a range of the open file, see
+// fallocate(2). Modes of FUSE are those of Linux, as are backend.Falloc*.
+func (fh *FuseHandle) FAllocate(
+	ctx context.Context, req *fuse.FAllocateRequest) error {
+	log.Printf("FAllocate %v: Offset %v, Length %v, Mode %v",
+		fh.ino, req.Offset, req.Length, req.Mode)
+	if fh.flags == syscall.O_RDONLY {
+		return FuseError(syscall.EBADF)
+	}
+	return FuseError(fh.fs.Back.Fallocate(ctx, fh.ino, fh.handle,
+		int64(req.Offset), int64(req.Length), uint32(req.Mode)))
+}
+
+// Lock tries to acquire a POSIX record lock, see F_SETLK in fcntl(2), or a
+// BSD lock with LOCK_NB, see flock(2)
+func (fh *FuseHandle) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	log.Println("Lock", fh.ino, req)
+	return FuseError(fh.lock(ctx, req, false))
+}
+
+// LockWait is the blocking version of Lock, see F_SETLKW in fcntl(2). The
+// library cancels ctx when the request is interrupted.
+func (fh *FuseHandle) LockWait(
+	ctx context.Context, req *fuse.LockWaitRequest) error {
+	log.Println("LockWait", fh.ino, req)
+	return FuseError(fh.lock(ctx, (*fuse.LockRequest)(req), true))
+}
+
+// Unlock releases a POSIX record lock or a BSD lock
+func (fh *FuseHandle) Unlock(
+	ctx context.Context, req *fuse.UnlockRequest) error {
+	log.Println("Unlock", fh.ino, req)
+	return FuseError(fh.lock(ctx, (*fuse.LockRequest)(req), false))
+}
+
+// lock places or removes the lock requested by req. BSD locks are held by
+// the open file, POSIX record locks by the lock owner of the request.
+func (fh *FuseHandle) lock(
+	ctx context.Context, req *fuse.LockRequest, wait bool) error {
+	typ := lockType(req.Lock.Type)
+	if req.LockFlags&fuse.LockFlock != 0 {
+		return fh.fs.Back.Flock(ctx, fh.ino, fh.owner, typ, wait)
+	}
+	if err := fh.checkLockType(typ); err != nil {
+		return err
+	}
+	return fh.fs.Back.Setlk(ctx, fh.ino, fileLock(
+		typ, &req.Lock, uint64(req.LockOwner)), wait)
+}
+
+// QueryLock tests for a POSIX record lock, see F_GETLK in fcntl(2). If the
+// lock could be placed, resp is left as the library fills it, with type
+// F_UNLCK; otherwise it describes one of the conflicting locks.
+func (fh *FuseHandle) QueryLock(ctx context.Context,
+	req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	log.Println("QueryLock", fh.ino, req)
+	lk := fileLock(lockType(req.Lock.Type), &req.Lock, uint64(req.LockOwner))
+	c, err := fh.fs.Back.Getlk(ctx, fh.ino, lk)
+	if err != nil {
+		return FuseError(err)
+	}
+	if c != nil {
+		resp.Lock = fuse.FileLock{
+			Start: c.Start,
+			End:   c.End,
+			Type:  fuseLockType(c.Type),
+			PID:   int32(c.Pid),
+		}
+		if c.End == backend.LockEOF {
+			resp.Lock.End = offsetMax
+		}
+	}
+	return nil
+}
+
+// offsetMax is the End of a lock that extends to the end of file in FUSE
+// requests, which is OFFSET_MAX of the kernel
+const offsetMax = math.MaxInt64
+
+// fileLock converts a lock of type typ in a FUSE request to a
+// backend.FileLock
+func fileLock(
+	typ backend.LockType, lk *fuse.FileLock, owner uint64) *backend.FileLock {
+	res := &backend.FileLock{
+		Type:  typ,
+		Start: lk.Start,
+		End:   lk.End,
+		Owner: owner,
+		Pid:   uint32(lk.PID),
+	}
+	if lk.End >= offsetMax {
+		res.End = backend.LockEOF
+	}
+	return res
+}
+
+// lockType converts a lock type of FUSE to a backend.LockType
+func lockType(typ fuse.LockType) backend.LockType {
+	switch typ {
+	case fuse.LockRead:
+		return backend.LockRead
+	case fuse.LockWrite:
+		return backend.LockWrite
+	}
+	return backend.LockUnlock
+}
+
+// fuseLockType converts a backend.LockType to a lock type of FUSE
+func fuseLockType(typ backend.LockType) fuse.LockType {
+	switch typ {
+	case backend.LockRead:
+		return fuse.LockRead
+	case backend.LockWrite:
+		return fuse.LockWrite
+	}
+	return fuse.LockUnlock
+}
+
+// A read lock requires the file to be open for reading, and a write lock
+// requires it to be open for writing
+func (fh *FuseHandle) checkLockType(typ backend.LockType) error {
+	if (typ == backend.LockRead && fh.flags == syscall.O_WRONLY) ||
+		(typ == backend.LockWrite && fh.flags == syscall.O_RDONLY) {
+		return syscall.EBADF
+	}
+	return nil
+}
+
+func (fh *FuseHandle) Release(
+	ctx context.Context, req *fuse.ReleaseRequest) error {
+	log.Println("Realese", fh.ino, req.Flags, req.ReleaseFlags)
+	flags := fh.fs.openBackendFlags(req.Flags) & syscall.O_ACCMODE
+	if flags != fh.flags {
+		log.Printf("Bug: 'flags' in RELEASE request (%v) is not same as "+
+			"'flags' in the corresponding OPEN request (%v)",
+			fuse.OpenFlags(flags), fuse.OpenFlags(fh.flags))
+	}
+	// Releasedir: req.Flags&syscall.O_DIRECTORY != 0
+
+	fh.node.removeHandle(fh)
+	err := fh.fs.Back.Flock(ctx, fh.ino, fh.owner, backend.LockUnlock, false)
+	if err != nil {
+		return FuseError(err)
+	}
+	return FuseError(fh.fs.Back.Release(ctx, fh.ino, fh.handle, fh.flags))
+}
+
+// readDir reads directory entries starting from the position indicated by
+// req.Offset, which is either 0 or an offset of an entry returned earlier.
+// It fills resp.Data with as many entries as fit in req.Size bytes.
+func (fh *FuseHandle) readDir(ctx context.Context,
+	req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	marker, err := fh.marker(uint64(req.Offset))
+	if err != nil {
+		return FuseError(err)
+	}
+
+	// Maximum number of entries that fit in the response
+	n := req.Size / fuseDirentSize
+	if n == 0 {
+		return nil
+	}
+	for {
+		dirents, next, err := fh.fs.Back.Readdir(ctx, fh.ino, marker, n)
+		if err != nil {
+			return FuseError(err)
+		}
+		for _, dirent := range dirents {
+			data := appendDirent(resp.Data, &dirent, fh.offset(dirent.Marker))
+			if len(data) > req.Size {
+				return nil
+			}
+			resp.Data = data
+		}
+		if len(next) == 0 || len(dirents) == 0 {
+			return nil
+		}
+		marker = next
+	}
+}
+
+// offset returns the readdir offset representing a marker
+func (fh *FuseHandle) offset(marker string) uint64 {
+	off, err := strconv.ParseUint(marker, 10, 63)
+	if err == nil && off > 0 && strconv.FormatUint(off, 10) == marker {
+		return off
+	}
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	fh.markers = append(fh.markers, marker)
+	return readdirTableOffset | uint64(len(fh.markers))
+}
+
+// marker returns the marker represented by a readdir offset
+func (fh *FuseHandle) marker(off uint64) (string, error) {
+	if off == 0 {
+		return "", nil
+	}
+	if off&readdirTableOffset == 0 {
+		return strconv.FormatUint(off, 10), nil
+	}
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	i := off &^ readdirTableOffset
+	if i == 0 || i > uint64(len(fh.markers)) {
+		return "", syscall.EINVAL
+	}
+	return fh.markers[i-1], nil
+}
+
+// fuseDirent is the layout of struct fuse_dirent in FUSE protocol, which is
+// followed by the name of entry padded to 8 bytes.
+type fuseDirent struct {
+	Ino     uint64
+	Off     uint64
+	Namelen uint32
+	Type    uint32
+}
+
+const fuseDirentSize = int(unsafe.Sizeof(fuseDirent{}))
+
+// appendDirent appends a directory entry to data, which is to be sent to
+// the kernel in response to READDIR. off is the offset of the next entry.
+// fuse.AppendDirent is not used because it sets offsets to positions in data.
+func appendDirent(data []byte, dirent *backend.Dirent, off uint64) []byte {
+	de := fuseDirent{
+		Ino:     dirent.Ino,
+		Off:     off,
+		Namelen: uint32(len(dirent.Name)),
+		Type:    uint32(direntType(dirent.Type)),
+	}
+	data = append(data, (*[fuseDirentSize]byte)(unsafe.Pointer(&de))[:]...)
+	data = append(data, dirent.Name...)
+	if n := (fuseDirentSize + len(dirent.Name)) % 8; n != 0 {
+		var pad [8]byte
+		data = append(data, pad[:8-n]...)
+	}
+	return data
+}
+
+// direntType converts file type bits of a file mode to a fuse.DirentType
+func direntType(mode os.FileMode) fuse.DirentType {
+	switch {
+	case mode&os.ModeDir != 0:
+		return fuse.DT_Dir
+	case mode&os.ModeSymlink != 0:
+		return fuse.DT_Link
+	case mode&os.ModeNamedPipe != 0:
+		return fuse.DT_FIFO
+	case mode&os.ModeSocket != 0:
+		return fuse.DT_Socket
+	case mode&os.ModeCharDevice != 0:
+		return fuse.DT_Char
+	case mode&os.ModeDevice != 0:
+		return fuse.DT_Block
+	case mode&os.ModeType == 0:
+		return fuse.DT_File
+	}
+	return fuse.DT_Unknown
+}
@@ -0,0 +1,88 @@
+package fusefs
+
+import (
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"fused/memfs"
+)
+
+// response is how the library logs a response, see FS.debug
+type response struct {
+	Op  string
+	Out interface{}
+}
+
+// open opens node as the library does, replying with handle ID id
+func open(t *testing.T, node *FuseNode, id fuse.HandleID) *FuseHandle {
+	t.Helper()
+	req := &fuse.OpenRequest{Dir: true, Flags: fuse.OpenReadOnly}
+	resp := &fuse.OpenResponse{}
+	h, err := node.Open(context.Background(), req, resp)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if fh := node.loadHandle(id); fh != nil {
+		t.Fatalf("handle %v is known before the reply", id)
+	}
+	resp.Handle = id
+	node.fs.debug(response{Op: "Open", Out: resp})
+	return h.(*FuseHandle)
+}
+
+func TestHandleID(t *testing.T) {
+	s := NewFS(memfs.NewMemFS())
+	root := s.loadNode(1, nil)
+
+	// The library numbers handles from 0
+	fh0 := open(t, root, 0)
+	fh1 := open(t, root, 1)
+	if fh := root.loadHandle(0); fh != fh0 {
+		t.Errorf("handle 0: got %p, want %p", fh, fh0)
+	}
+	if fh := root.loadHandle(1); fh != fh1 {
+		t.Errorf("handle 1: got %p, want %p", fh, fh1)
+	}
+	if fh := root.loadHandle(2); fh != nil {
+		t.Errorf("handle 2: got %p, want nil", fh)
+	}
+
+	// Other messages are only logged
+	s.debug(response{Op: "Getattr", Out: &fuse.GetattrResponse{}})
+	s.debug("message")
+
+	err := fh0.Release(context.Background(), &fuse.ReleaseRequest{
+		Handle: 0, Flags: fuse.OpenReadOnly})
+	if err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if fh := root.loadHandle(0); fh != nil {
+		t.Errorf("handle 0 after release: got %p, want nil", fh)
+	}
+
+	// A released ID is reused by the next open
+	if fh := open(t, root, 0); root.loadHandle(0) != fh {
+		t.Errorf("reused handle 0 is not found")
+	}
+	if len(s.handles) != 0 {
+		t.Errorf("%d handles are left being opened", len(s.handles))
+	}
+}
+
+func TestFsyncUnbound(t *testing.T) {
+	s := NewFS(memfs.NewMemFS())
+	root := s.loadNode(1, nil)
+	open(t, root, 0)
+
+	// A handle is synchronized through its ID, and the file as a whole if
+	// the ID is unknown
+	for _, id := range []fuse.HandleID{0, 5} {
+		err := root.Fsync(context.Background(),
+			&fuse.FsyncRequest{Handle: id, Dir: true})
+		if err != nil {
+			t.Errorf("Fsync of handle %v: %v", id, err)
+		}
+	}
+}
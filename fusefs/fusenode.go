@@ -0,0 +1,549 @@
+package fusefs
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"fused/backend"
+)
+
+// FuseNode implements:
+//   fuse.Node
+//   fuse.NodeGetattrer
+//   fuse.NodeRequestLookuper
+//   fuse.NodeOpener
+//   fuse.NodeCreater
+//   fuse.NodeMkdirer
+//   fuse.NodeMknoder
+//   fuse.NodeRemover
+//   fuse.NodeRenamer
+//   fuse.NodeLinker
+//   fuse.NodeSymlinker
+//   fuse.NodeReadlinker
+//   fuse.NodeSetattrer
+//   fuse.NodeForgetter
+//   fuse.NodeFsyncer
+//   fuse.NodeAccesser
+//   fuse.NodeGetxattrer
+//   fuse.NodeListxattrer
+//   fuse.NodeSetxattrer
+//   fuse.NodeRemovexattrer
+type FuseNode struct {
+	fs         *FS
+	ino        uint64
+	generation uint64 // Generation number of the inode
+	attr       *backend.Stat
+
+	mu      sync.Mutex    // Lock protecting handles
+	handles []*FuseHandle // Open handles of the node
+}
+
+// This is a compile-time assertion to ensure that FuseNode implements
+// fs.NodeRequestLookuper interface, which sets timeouts of names cached
+var _ fs.NodeRequestLookuper = (*FuseNode)(nil)
+
+func newFuseNode(fs *FS, ino uint64, attr *backend.Stat) *FuseNode {
+	fn := &FuseNode{
+		fs:   fs,
+		ino:  ino,
+		attr: attr,
+	}
+	if attr != nil {
+		fn.generation = attr.Generation
+	}
+	return fn
+}
+
+// This method should be called with lock being held
+func (fn *FuseNode) update(stat *backend.Stat) {
+	fn.attr = stat
+}
+
+// addHandle registers an open handle of the node
+func (fn *FuseNode) addHandle(fh *FuseHandle) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	fn.handles = append(fn.handles, fh)
+}
+
+// removeHandle unregisters a released handle of the node
+func (fn *FuseNode) removeHandle(fh *FuseHandle) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	for i, h := range fn.handles {
+		if h == fh {
+			fn.handles = append(fn.handles[:i], fn.handles[i+1:]...)
+			return
+		}
+	}
+}
+
+// loadHandle returns the open handle of the node identified by id, or nil if
+// there is none
+func (fn *FuseNode) loadHandle(id fuse.HandleID) *FuseHandle {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	for _, h := range fn.handles {
+		if h.hasID(id) {
+			return h
+		}
+	}
+	return nil
+}
+
+// This method will be called by the FUSE library when replying the
+// following requests:
+//   LOOKUP, MKDIR, CREATE, MKNOD, SYNLINK, LINK
+func (fn *FuseNode) Attr(_ context.Context, a *fuse.Attr) error {
+	log.Println("Attr", fn.ino)
+	fillAttr(fn.attr, a)
+	fn.fs.Override.apply(a)
+	a.Valid = fn.fs.Cache.AttrTimeout
+	return nil
+}
+
+// GETATTR request handler
+func (fn *FuseNode) Getattr(ctx context.Context, _ *fuse.GetattrRequest,
+	resp *fuse.GetattrResponse) error {
+	log.Println("Getattr", fn.ino)
+
+	stat, err := fn.fs.Back.Stat(ctx, fn.ino)
+	if err != nil {
+		return FuseError(err)
+	}
+	fillAttr(stat, &resp.Attr)
+	fn.fs.Override.apply(&resp.Attr)
+	resp.Attr.Valid = fn.fs.Cache.AttrTimeout
+	return nil
+}
+
+func (fn *FuseNode) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	log.Println("Lookup", fn.ino, req.Name)
+
+	// Resolving a name requires search permission on the directory, which
+	// the kernel does not check unless mounted with default_permissions
+	if err := fn.checkAccess(ctx, &req.Header, accessExec); err != nil {
+		return nil, FuseError(err)
+	}
+	stat, err := fn.fs.Back.Lookup(ctx, fn.ino, req.Name)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+
+	resp.EntryValid = fn.fs.Cache.EntryTimeout
+	return fn.fs.loadNode(stat.Ino, stat), nil
+}
+
+func (fn *FuseNode) Open(
+	ctx context.Context,
+	req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	log.Println("Open", fn.ino, req.Dir, req.Flags)
+
+	err := fn.checkAccess(ctx, &req.Header, openAccessMask(int(req.Flags)))
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	flags := fn.fs.openBackendFlags(req.Flags)
+	handle, err := fn.fs.Back.Open(ctx, fn.ino, flags)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	resp.Flags |= fn.fs.openFlags(req.Dir)
+	return newFuseHandle(fn, handle, flags, resp), nil
+}
+
+func (fn *FuseNode) Create(
+	ctx context.Context,
+	req *fuse.CreateRequest,
+	resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	log.Println("Create", fn.ino, req.Name, req.Flags, req.Mode)
+	err := fn.checkAccess(ctx, &req.Header, accessWrite|accessExec)
+	if err != nil {
+		return nil, nil, FuseError(err)
+	}
+	flags := fn.fs.openBackendFlags(req.Flags)
+	stat, handle, err := fn.fs.Back.Create(ctx, fn.ino, req.Name, flags,
+		req.Mode, req.Header.Uid, req.Header.Gid)
+	if err != nil {
+		return nil, nil, FuseError(err)
+	}
+	node := fn.fs.loadNode(stat.Ino, stat)
+	resp.EntryValid = fn.fs.Cache.EntryTimeout
+	resp.Flags |= fn.fs.openFlags(false)
+	return node, newFuseHandle(node, handle, flags, &resp.OpenResponse), nil
+}
+
+func (fn *FuseNode) Mkdir(
+	ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	log.Println("Mkdir", fn.ino, req.Name, req.Mode)
+	err := fn.checkAccess(ctx, &req.Header, accessWrite|accessExec)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	stat, err := fn.fs.Back.Mkdir(ctx,
+		fn.ino, req.Name, req.Mode, req.Header.Uid, req.Header.Gid)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	return fn.fs.loadNode(stat.Ino, stat), nil
+}
+
+func (fn *FuseNode) Mknod(
+	ctx context.Context, req *fuse.MknodRequest) (fs.Node, error) {
+	log.Println("Mknod", fn.ino, req.Name, req.Mode, req.Rdev)
+	err := fn.checkAccess(ctx, &req.Header, accessWrite|accessExec)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	stat, err := fn.fs.Back.Mknod(ctx, fn.ino, req.Name, req.Mode, req.Rdev,
+		req.Header.Uid, req.Header.Gid)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	return fn.fs.loadNode(stat.Ino, stat), nil
+}
+
+func (fn *FuseNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	log.Printf("Remove %v %s: Dir %v", fn.ino, req.Name, req.Dir)
+	if err := fn.checkRemove(ctx, &req.Header, req.Name); err != nil {
+		return FuseError(err)
+	}
+	if req.Dir {
+		return FuseError(fn.fs.Back.Rmdir(ctx, fn.ino, req.Name))
+	}
+	return FuseError(fn.fs.Back.Unlink(ctx, fn.ino, req.Name))
+}
+
+func (fn *FuseNode) Rename(
+	ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	log.Printf("Rename <%v, %s> to <%v, %s>",
+		fn.ino, req.OldName, req.NewDir, req.NewName)
+	dNode, _ := newDir.(*FuseNode)
+	if err := fn.checkRename(ctx, &req.Header, req, dNode); err != nil {
+		return FuseError(err)
+	}
+	return FuseError(fn.fs.Back.Rename(ctx,
+		fn.ino, req.OldName, dNode.ino, req.NewName, 0))
+}
+
+func (fn *FuseNode) Link(
+	ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	oldFn, _ := old.(*FuseNode)
+	log.Printf("Link <%v, %s> to %v", fn.ino, req.NewName, oldFn.ino)
+	err := fn.checkAccess(ctx, &req.Header, accessWrite|accessExec)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	stat, err := fn.fs.Back.Link(ctx, oldFn.ino, fn.ino, req.NewName)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	return fn.fs.loadNode(stat.Ino, stat), nil
+}
+
+func (fn *FuseNode) Symlink(
+	ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	log.Printf("Symlink <%v, %s> to %s", fn.ino, req.NewName, req.Target)
+	err := fn.checkAccess(ctx, &req.Header, accessWrite|accessExec)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	stat, err := fn.fs.Back.Symlink(ctx, fn.ino, req.NewName, req.Target,
+		req.Header.Uid, req.Header.Gid)
+	if err != nil {
+		return nil, FuseError(err)
+	}
+	return fn.fs.loadNode(stat.Ino, stat), nil
+}
+
+func (fn *FuseNode) Readlink(
+	ctx context.Context, _ *fuse.ReadlinkRequest) (string, error) {
+	log.Println("Readlink", fn.ino)
+	target, err := fn.fs.Back.Readlink(ctx, fn.ino)
+	if err != nil {
+		return "", FuseError(err)
+	}
+	return target, nil
+}
+
+func (fn *FuseNode) Setattr(
+	ctx context.Context,
+	req *fuse.SetattrRequest, _ *fuse.SetattrResponse) error {
+	log.Println("Setattr", fn.ino, req)
+
+	cur, err := fn.fs.Back.Stat(ctx, fn.ino)
+	if err != nil {
+		return FuseError(err)
+	}
+	// ftruncate, fchmod ...
+	var fh *FuseHandle
+	if req.Valid.Handle() {
+		fh = fn.loadHandle(req.Handle)
+	}
+	// Whether the handle may truncate the file is up to the access mode it
+	// is opened with
+	writable := fh != nil && fh.flags != syscall.O_RDONLY
+	if err := fn.fs.checkSetattr(req, cur, writable); err != nil {
+		return FuseError(err)
+	}
+
+	var attrs backend.SetattrRequest
+
+	// Chmod, change permissions of a file
+	if req.Valid&fuse.SetattrMode != 0 {
+		mode := req.Mode
+		if !fn.fs.DefaultPermissions && req.Header.Uid != 0 &&
+			!isGroupMember(&req.Header, cur.GID) {
+			// The set-group-ID bit is cleared if the group of the file does
+			// not match the requester's
+			mode &^= os.ModeSetgid
+		}
+		attrs.Valid |= backend.SetattrMode
+		attrs.Mode = mode
+	}
+
+	// Chown, change file owner and group
+	if req.Valid&fuse.SetattrGid != 0 {
+		attrs.Valid |= backend.SetattrGID
+		attrs.GID = req.Gid
+	}
+	if req.Valid&fuse.SetattrUid != 0 {
+		attrs.Valid |= backend.SetattrUID
+		attrs.UID = req.Uid
+	}
+
+	// Open(O_TRUNC), truncate ftruncate ...
+	if req.Valid&fuse.SetattrSize != 0 {
+		attrs.Valid |= backend.SetattrSize
+		attrs.Size = req.Size
+	}
+
+	// Change file last access and modification times:
+	//   futimes, utimes, utimensat ...
+	// A time of UTIME_NOW is set to the current time, and a time of
+	// UTIME_OMIT is not sent by the kernel
+	now := time.Now()
+	if req.Valid&fuse.SetattrAtime != 0 {
+		attrs.Valid |= backend.SetattrAtime
+		attrs.Atime = req.Atime
+		if req.Valid.AtimeNow() {
+			attrs.Atime = now
+		}
+	}
+	if req.Valid&fuse.SetattrMtime != 0 {
+		attrs.Valid |= backend.SetattrMtime
+		attrs.Mtime = req.Mtime
+		if req.Valid.MtimeNow() {
+			attrs.Mtime = now
+		}
+	}
+
+	if attrs.Valid == 0 {
+		return FuseError(syscall.EINVAL)
+	}
+
+	if fh != nil {
+		attrs.Valid |= backend.SetattrHandle
+		attrs.Handle = fh.handle
+	}
+
+	stat, err := fn.fs.Back.Setattr(ctx, fn.ino, &attrs)
+	if err != nil {
+		return FuseError(err)
+	}
+	fn.update(stat)
+	return nil
+}
+
+func (fn *FuseNode) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	log.Println("Access", fn.ino, req.Mask)
+	return FuseError(fn.checkAccess(ctx,
+		&req.Header, req.Mask&(accessRead|accessWrite|accessExec)))
+}
+
+// checkAccess checks whether the requester is allowed to access the node
+func (fn *FuseNode) checkAccess(
+	ctx context.Context, h *fuse.Header, mask uint32) error {
+	if fn.fs.DefaultPermissions {
+		return nil
+	}
+	stat, err := fn.fs.Back.Stat(ctx, fn.ino)
+	if err != nil {
+		return err
+	}
+	return fn.fs.checkAccess(h, stat, mask)
+}
+
+// checkRemove checks whether the requester is allowed to remove the entry
+// name from the directory node
+func (fn *FuseNode) checkRemove(
+	ctx context.Context, h *fuse.Header, name string) error {
+	if fn.fs.DefaultPermissions {
+		return nil
+	}
+	dir, err := fn.fs.Back.Stat(ctx, fn.ino)
+	if err != nil {
+		return err
+	}
+	if err := fn.fs.checkAccess(h, dir, accessWrite|accessExec); err != nil {
+		return err
+	}
+	stat, err := fn.fs.Back.Lookup(ctx, fn.ino, name)
+	if err != nil {
+		return err
+	}
+	return fn.fs.checkSticky(h, dir, stat)
+}
+
+// checkRename checks whether the requester is allowed to move an entry from
+// the directory node to directory dNode
+func (fn *FuseNode) checkRename(ctx context.Context, h *fuse.Header,
+	req *fuse.RenameRequest, dNode *FuseNode) error {
+	if fn.fs.DefaultPermissions {
+		return nil
+	}
+	if err := fn.checkRemove(ctx, h, req.OldName); err != nil {
+		return err
+	}
+	err := dNode.checkRemove(ctx, h, req.NewName)
+	if err == syscall.ENOENT {
+		err = dNode.checkAccess(ctx, h, accessWrite|accessExec)
+	}
+	if err != nil {
+		return err
+	}
+
+	if fn.ino != dNode.ino {
+		// Moving a directory to another directory updates its ".." entry
+		return fn.checkMoveDir(ctx, h, req.OldName)
+	}
+	return nil
+}
+
+// checkMoveDir checks whether the requester is allowed to move the entry
+// name out of the directory node, if the entry is a directory
+func (fn *FuseNode) checkMoveDir(
+	ctx context.Context, h *fuse.Header, name string) error {
+	stat, err := fn.fs.Back.Lookup(ctx, fn.ino, name)
+	if err != nil {
+		return err
+	}
+	if stat.Mode.IsDir() {
+		return fn.fs.checkAccess(h, stat, accessWrite)
+	}
+	return nil
+}
+
+func (fn *FuseNode) Forget() {
+	log.Println("Forget", fn.ino)
+	fn.fs.removeNode(fn)
+}
+
+// This should be a Handle method, but brazil.org/fuse treats
+//   it as a Node method :(
+func (fn *FuseNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	log.Printf("Fsync %v: Handle %v, Flags %v, Dir %v",
+		fn.ino, req.Handle, req.Flags, req.Dir)
+	// The handle is always known, unless the library has not reported its
+	// ID, in which case the inode is synchronized as a whole
+	var handle backend.HandleID
+	if fh := fn.loadHandle(req.Handle); fh != nil {
+		handle = fh.handle
+	} else {
+		log.Printf("Warning: handle %v of %v is unknown", req.Handle, fn.ino)
+	}
+	return FuseError(
+		fn.fs.Back.Fsync(ctx, fn.ino, handle, req.Flags, req.Dir))
+}
+
+func (fn *FuseNode) Getxattr(ctx context.Context,
+	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	log.Println("Getxattr", fn.ino, req.Name, req.Size)
+	if !xattrAccessible(&req.Header, req.Name) {
+		return fuse.ErrNoXattr
+	}
+	value, err := fn.fs.Back.Getxattr(ctx, fn.ino, req.Name)
+	if err != nil {
+		return FuseError(err)
+	}
+	// A size of 0 asks for the size of the value only
+	if req.Size != 0 && len(value) > int(req.Size) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	resp.Xattr = value
+	return nil
+}
+
+func (fn *FuseNode) Listxattr(ctx context.Context,
+	req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	log.Println("Listxattr", fn.ino, req.Size)
+	names, err := fn.fs.Back.Listxattr(ctx, fn.ino)
+	if err != nil {
+		return FuseError(err)
+	}
+	for _, name := range names {
+		if xattrAccessible(&req.Header, name) {
+			resp.Append(name)
+		}
+	}
+	if req.Size != 0 && len(resp.Xattr) > int(req.Size) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	return nil
+}
+
+func (fn *FuseNode) Setxattr(
+	ctx context.Context, req *fuse.SetxattrRequest) error {
+	log.Println("Setxattr", fn.ino, req.Name, len(req.Xattr), req.Flags)
+	if !xattrAccessible(&req.Header, req.Name) {
+		return FuseError(syscall.EPERM)
+	}
+	return FuseError(
+		fn.fs.Back.Setxattr(ctx, fn.ino, req.Name, req.Xattr, req.Flags))
+}
+
+func (fn *FuseNode) Removexattr(
+	ctx context.Context, req *fuse.RemovexattrRequest) error {
+	log.Println("Removexattr", fn.ino, req.Name)
+	if !xattrAccessible(&req.Header, req.Name) {
+		return FuseError(syscall.EPERM)
+	}
+	return FuseError(fn.fs.Back.Removexattr(ctx, fn.ino, req.Name))
+}
+
+// xattrAccessible reports whether the requester is allowed to access the
+// extended attribute name. Attributes in the "trusted." namespace are only
+// visible to privileged processes.
+func xattrAccessible(h *fuse.Header, name string) bool {
+	return !strings.HasPrefix(name, "trusted.") || h.Uid == 0
+}
+
+// fillAttr fills attr with stat. fuse.Attr has no generation number; the
+// library reports generation numbers of nodes itself, see FS.nodeMap.
+func fillAttr(stat *backend.Stat, attr *fuse.Attr) {
+	if stat == nil || attr == nil {
+		log.Printf("Warnning: fillAttr(%v, %v)", stat, attr)
+		return
+	}
+	attr.Inode = stat.Ino
+	attr.Size = stat.Size
+	attr.BlockSize = stat.BlockSize
+	attr.Blocks = stat.Blocks
+	attr.Atime = stat.Atime
+	attr.Mtime = stat.Mtime
+	attr.Ctime = stat.Ctime
+	attr.Mode = stat.Mode
+	attr.Nlink = stat.Nlink
+	attr.Uid = stat.UID
+	attr.Gid = stat.GID
+	attr.Rdev = stat.Rdev
+}
@@ -0,0 +1,86 @@
+package fusefs
+
+import (
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"fused/memfs"
+)
+
+// create creates file name in directory dir as user uid, and replies with
+// handle ID id as the library does
+func create(t *testing.T, dir *FuseNode, name string, flags fuse.OpenFlags,
+	uid uint32, id fuse.HandleID) *FuseNode {
+	t.Helper()
+	req := &fuse.CreateRequest{
+		Header: fuse.Header{Uid: uid, Gid: uid},
+		Name:   name,
+		Flags:  flags,
+		Mode:   0600,
+	}
+	resp := &fuse.CreateResponse{}
+	node, _, err := dir.Create(context.Background(), req, resp)
+	if err != nil {
+		t.Fatalf("Create %s: %v", name, err)
+	}
+	resp.Handle = id
+	dir.fs.debug(response{Op: "Create", Out: resp})
+	return node.(*FuseNode)
+}
+
+// setattr sets attributes of node as user uid
+func setattr(node *FuseNode, uid uint32, req fuse.SetattrRequest) error {
+	req.Header = fuse.Header{Uid: uid, Gid: uid}
+	return node.Setattr(context.Background(), &req, &fuse.SetattrResponse{})
+}
+
+func TestTruncatePermission(t *testing.T) {
+	s := NewFS(memfs.NewMemFS())
+	root := s.loadNode(1, nil)
+	const uid = 1000
+
+	for _, tc := range []struct {
+		flags fuse.OpenFlags
+		want  error
+	}{
+		{fuse.OpenWriteOnly, nil},
+		{fuse.OpenReadWrite, nil},
+		{fuse.OpenReadOnly, fuse.Errno(syscall.EACCES)},
+	} {
+		// As test_ftruncate of test_syscalls.c, the file is made read-only
+		// through the handle, which is the first request on it
+		name := tc.flags.String()
+		node := create(t, root, name, tc.flags, uid, 1)
+		err := setattr(node, uid, fuse.SetattrRequest{
+			Valid:  fuse.SetattrMode | fuse.SetattrHandle,
+			Handle: 1,
+			Mode:   0400,
+		})
+		if err != nil {
+			t.Fatalf("%s: fchmod: %v", name, err)
+		}
+		err = setattr(node, uid, fuse.SetattrRequest{
+			Valid:  fuse.SetattrSize | fuse.SetattrHandle,
+			Handle: 1,
+		})
+		if err != tc.want {
+			t.Errorf("%s: ftruncate: got %v, want %v", name, err, tc.want)
+		}
+
+		// Without a handle, as truncate(2) and O_TRUNC, write permission
+		// is required
+		err = setattr(node, uid, fuse.SetattrRequest{Valid: fuse.SetattrSize})
+		if err != fuse.Errno(syscall.EACCES) {
+			t.Errorf("%s: truncate: got %v, want EACCES", name, err)
+		}
+
+		rel := &fuse.ReleaseRequest{Handle: 1, Flags: tc.flags}
+		fh := node.loadHandle(1)
+		if err := fh.Release(context.Background(), rel); err != nil {
+			t.Fatalf("%s: Release: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package fusefs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+
+	"fused/backend"
+)
+
+// Access mode bits, same as R_OK, W_OK and X_OK in <unistd.h>
+const (
+	accessRead  = 0x4
+	accessWrite = 0x2
+	accessExec  = 0x1
+)
+
+// checkAccess checks whether the requester is allowed to access a file with
+// attributes stat. mask is a bitwise OR of accessRead, accessWrite and
+// accessExec. checkAccess returns syscall.EACCES if access is denied.
+func (s *FS) checkAccess(
+	h *fuse.Header, stat *backend.Stat, mask uint32) error {
+	if s.DefaultPermissions {
+		// Permission checking is done by the kernel
+		return nil
+	}
+
+	mode := uint32(stat.Mode.Perm())
+	if h.Uid == 0 {
+		// Superuser is granted read and write access to any file, and
+		// execute access if the file is a directory or any of its execute
+		// bits is set
+		if mask&accessExec == 0 || stat.Mode.IsDir() || mode&0111 != 0 {
+			return nil
+		}
+		return syscall.EACCES
+	}
+
+	var perm uint32
+	switch {
+	case h.Uid == stat.UID:
+		perm = mode >> 6
+	case isGroupMember(h, stat.GID):
+		perm = mode >> 3
+	default:
+		perm = mode
+	}
+	if perm&mask != mask {
+		return syscall.EACCES
+	}
+	return nil
+}
+
+// checkOwner checks whether the requester owns a file with attributes stat,
+// which is required to change its mode, times and so on. checkOwner returns
+// syscall.EPERM if it does not.
+func (s *FS) checkOwner(h *fuse.Header, stat *backend.Stat) error {
+	if s.DefaultPermissions || h.Uid == 0 || h.Uid == stat.UID {
+		return nil
+	}
+	return syscall.EPERM
+}
+
+// checkSticky checks whether the requester is allowed to remove or rename an
+// entry with attributes stat from directory dir. If dir has its sticky bit
+// set, only owner of the entry, owner of the directory and superuser are
+// allowed to do so.
+func (s *FS) checkSticky(
+	h *fuse.Header, dir *backend.Stat, stat *backend.Stat) error {
+	if s.DefaultPermissions || dir.Mode&os.ModeSticky == 0 {
+		return nil
+	}
+	if h.Uid == 0 || h.Uid == stat.UID || h.Uid == dir.UID {
+		return nil
+	}
+	return syscall.EPERM
+}
+
+// checkSetattr checks whether the requester is allowed to change attributes
+// of a file with attributes stat as req requests. writable tells whether the
+// request is made via a handle open for writing.
+func (s *FS) checkSetattr(
+	req *fuse.SetattrRequest, stat *backend.Stat, writable bool) error {
+	if s.DefaultPermissions {
+		return nil
+	}
+
+	h := &req.Header
+	if req.Valid.Mode() {
+		if err := s.checkOwner(h, stat); err != nil {
+			return err
+		}
+	}
+
+	// Only superuser may change owner of a file. Owner of a file may change
+	// its group to any group of which the owner is a member.
+	if req.Valid.Uid() && req.Uid != stat.UID && h.Uid != 0 {
+		return syscall.EPERM
+	}
+	if req.Valid.Uid() || req.Valid.Gid() {
+		if err := s.checkOwner(h, stat); err != nil {
+			return err
+		}
+	}
+	if req.Valid.Gid() && req.Gid != stat.GID && h.Uid != 0 &&
+		!isGroupMember(h, req.Gid) {
+		return syscall.EPERM
+	}
+
+	// Truncating a file requires write permission, unless it is done via a
+	// file descriptor open for writing, whose access mode is checked on open.
+	// The kernel truncates a file opened with O_TRUNC without a handle, which
+	// may be read-only for O_RDONLY|O_TRUNC.
+	if req.Valid.Size() && !writable {
+		if err := s.checkAccess(h, stat, accessWrite); err != nil {
+			return err
+		}
+	}
+
+	// Setting file times to the current time requires either ownership or
+	// write permission, setting them to any other value requires ownership
+	if req.Valid.Atime() || req.Valid.Mtime() {
+		now := (!req.Valid.Atime() || req.Valid.AtimeNow()) &&
+			(!req.Valid.Mtime() || req.Valid.MtimeNow())
+		if err := s.checkOwner(h, stat); err != nil {
+			if !now {
+				return err
+			}
+			return s.checkAccess(h, stat, accessWrite)
+		}
+	}
+	return nil
+}
+
+// isGroupMember reports whether the requester is a member of group gid,
+// either as its effective group or one of its supplementary groups.
+func isGroupMember(h *fuse.Header, gid uint32) bool {
+	if h.Gid == gid {
+		return true
+	}
+	for _, g := range supplementaryGroups(h.Pid) {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// supplementaryGroups returns the supplementary group IDs of a process.
+// FUSE requests carry only the effective user and group IDs of the
+// requester, so the groups are read from /proc on Linux. It returns nil if
+// the groups are unknown.
+func supplementaryGroups(pid uint32) []uint32 {
+	if runtime.GOOS != "linux" || pid == 0 {
+		return nil
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var groups []uint32
+		for _, field := range strings.Fields(line[len("Groups:"):]) {
+			if g, err := strconv.ParseUint(field, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// openAccessMask returns the access mode bits required for opening a file
+// with flags
+func openAccessMask(flags int) uint32 {
+	var mask uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mask = accessRead
+	case syscall.O_WRONLY:
+		mask = accessWrite
+	case syscall.O_RDWR:
+		mask = accessRead | accessWrite
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mask |= accessWrite
+	}
+	return mask
+}
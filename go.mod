@@ -1,8 +1,10 @@
 module fused
 
-go 1.12
+go 1.19
 
 require (
-	bazil.org/fuse v0.0.0-20191225233854-3a99aca11732
-	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
+	bazil.org/fuse v0.0.0-20230120002735-62a210ff1fd5
+	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b
 )
+
+require golang.org/x/sys v0.4.0 // indirect
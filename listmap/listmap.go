@@ -1,4 +1,6 @@
-package main
+// Package listmap implements ListMap, a map that remembers the order in
+// which its keys are added.
+package listmap
 
 import (
 	"container/list"
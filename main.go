@@ -5,89 +5,214 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
 	_ "bazil.org/fuse/fs/fstestutil"
+
+	"fused/backend"
+	"fused/fusefs"
+	// Filesystem types, which register themselves
+	_ "fused/memfs"
 )
 
 const version = "0.0.1"
 
-var fstypes = [...]string{"memfs"}
-
 var usage = func() {
 	fmt.Fprintf(os.Stderr, "usage: %s [options] mountpoint\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s type mountpoint [-sfnv] [-o options]\n",
+		os.Args[0])
 	fmt.Fprintf(os.Stderr, " options:\n")
 	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, " mount options (-o):\n"+
+		"  ro, allow_other, default_permissions, dev, suid,\n"+
+		"  nonempty, uid=N, gid=N, umask=M, fsname=S, subtype=S,\n"+
+		"  attr_timeout=T, entry_timeout=T, kernel_cache, direct_io,\n"+
+		"  writeback_cache, noatime, relatime, strictatime, foreground\n")
+	fmt.Fprintf(os.Stderr, " filesystem types and their options (-o):\n")
+	for _, b := range backend.Backends() {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", b.Name, b.Description)
+		for _, o := range b.Options {
+			fmt.Fprintf(os.Stderr, "  -o %s\n    \t%s", optionSyntax(o),
+				o.Description)
+			if o.Default != "" {
+				fmt.Fprintf(os.Stderr, " (default %s)", o.Default)
+			}
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+// optionSyntax returns how backend option o is given, such as
+// "capacity=size"
+func optionSyntax(o backend.Option) string {
+	switch {
+	case o.Type == backend.OptionBool:
+		return o.Name
+	case len(o.Choices) > 0:
+		return o.Name + "=" + strings.Join(o.Choices, "|")
+	}
+	return fmt.Sprintf("%s=%v", o.Name, o.Type)
+}
+
+// optionList is a flag of comma-separated options, which may be given more
+// than once
+type optionList []string
+
+func (l *optionList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func validateFSType(fstype string) bool {
-	for _, t := range fstypes {
-		if fstype == t {
-			return true
+func (l *optionList) Set(value string) error {
+	for _, opt := range strings.Split(value, ",") {
+		if opt != "" {
+			*l = append(*l, opt)
 		}
 	}
-	return false
+	return nil
 }
 
-func NewFS(fstype string) fs.FS {
-	var back BackendFS
-	switch fstype {
-	default:
-		back = NewMemFS()
-	case "memfs":
-		back = NewMemFS()
-		// other fs types ...
+// NewFS creates a filesystem of backend b with options opts
+func NewFS(b *backend.Backend, opts []string,
+	defaultPermissions bool) (*fusefs.FS, error) {
+	parsed, err := b.ParseOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	back, err := b.New(parsed)
+	if err != nil {
+		return nil, err
 	}
-	return &FS{Back: back}
+	fsys := fusefs.NewFS(back)
+	fsys.DefaultPermissions = defaultPermissions
+	return fsys, nil
 }
 
 func main() {
 	flag.Usage = usage
 	vflag := flag.Bool("version", false, "print version information")
-	tflag := flag.String("type", "memfs", fmt.Sprintf(
-		"specify filesystem type. filesystems supported: %v", fstypes))
-	flag.Parse()
+	tflag := flag.String("type", "memfs", "specify filesystem type")
+	var oflag optionList
+	flag.Var(&oflag, "o",
+		"mount options and options of the filesystem type, as "+
+			"key[=value][,key[=value]...]")
+	args := os.Args[1:]
+	if !isHelperName(os.Args[0]) {
+		flag.Parse()
+		args = flag.Args()
+	}
 	if *vflag {
 		fmt.Fprintf(os.Stderr, "%s\n", version)
 	}
-	if flag.NArg() != 1 {
+	fstype, mountpoint := *tflag, flag.Arg(0)
+	var helper *helperArgs
+	// Given a type and a mountpoint, fused is run as a mount helper
+	if isHelperName(os.Args[0]) || len(args) >= 2 {
+		h, err := parseHelperArgs(args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			usage()
+			os.Exit(2)
+		}
+		helper = h
+		fstype, mountpoint = h.fstype, h.mountpoint
+		oflag = append(oflag, h.options...)
+	} else if flag.NArg() != 1 {
 		if *vflag {
 			os.Exit(0)
 		}
 		usage()
 		os.Exit(2)
 	}
-	fstype := *tflag
-	if !validateFSType(fstype) {
+	b, ok := backend.Lookup(fstype)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown filesystem type %s\n", fstype)
 		usage()
 		os.Exit(2)
 	}
 
-	mountpoint := flag.Arg(0)
+	mopts, err := parseMountOptions(b, oflag, helper != nil && helper.sloppy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		usage()
+		os.Exit(2)
+	}
+	options := append([]fuse.MountOption{
+		fuse.FSName(mopts.fsname),
+		fuse.Subtype(mopts.subtype),
+		// Locks are kept by the backend, so that they are visible to all
+		// its users rather than to the local kernel only
+		fuse.LockingPOSIX(),
+		fuse.LockingFlock(),
+	}, mopts.mount...)
+	if mopts.defaultPermissions {
+		options = append(options, fuse.DefaultPermissions())
+	}
 
-	c, err := fuse.Mount(
-		mountpoint,
-		fuse.FSName(fstype),
-		fuse.Subtype(fstype),
-		fuse.LocalVolume(),
-		fuse.VolumeName(fstype),
-		fuse.NoAppleDouble(),
-		fuse.NoAppleXattr(),
-	)
+	fsys, err := NewFS(b, mopts.backend, mopts.defaultPermissions)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		usage()
+		os.Exit(2)
 	}
-	defer c.Close()
+	fsys.Override = mopts.override
+	// Caching options given override the defaults of the filesystem type
+	for _, set := range mopts.cache {
+		set(&fsys.Cache)
+	}
+	if fsys.Cache.WritebackCache {
+		options = append(options, fuse.WritebackCache())
+	}
+
+	if helper != nil {
+		if helper.fake {
+			os.Exit(0)
+		}
+		// A mount helper returns once mounted, unless asked not to
+		if !mopts.foreground {
+			daemonize()
+		}
+	}
+	if err := serve(mountpoint, options, fsys); err != nil {
+		notifyReady(err)
+		log.Print(err)
+		os.Exit(1)
+	}
+}
 
-	err = fs.Serve(c, NewFS(fstype))
+// serve mounts fsys on mountpoint and serves it until it is unmounted,
+// either by the user or on a termination signal. The backend is closed
+// before serve returns.
+func serve(
+	mountpoint string, options []fuse.MountOption, fsys *fusefs.FS) error {
+	c, err := fuse.Mount(mountpoint, options...)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer c.Close()
+	// The filesystem is mounted and initialized once Mount returns
+	notifyReady(nil)
+	go unmountOnSignal(mountpoint)
 
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		log.Fatal(err)
+	err = fsys.Serve(c)
+	if closeErr := fsys.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// unmountOnSignal unmounts mountpoint when fused is asked to terminate, which
+// makes serving the filesystem return. If the filesystem is busy, it stays
+// mounted until the next signal.
+func unmountOnSignal(mountpoint string) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigc {
+		log.Printf("Received %v, unmounting %s", sig, mountpoint)
+		if err := fuse.Unmount(mountpoint); err != nil {
+			log.Printf("Failed to unmount %s: %v", mountpoint, err)
+		}
 	}
 }
@@ -0,0 +1,119 @@
+package memfs
+
+import (
+	"math"
+	"sort"
+)
+
+// extent is a range [off, end) of bytes in a file
+type extent struct {
+	off int64
+	end int64
+}
+
+// extentList is a sorted list of disjoint, non-adjacent extents, which
+// describes the blocks allocated to a file. Extents are aligned to
+// memfsBlockSize.
+type extentList []extent
+
+// alignDown and alignUp round an offset to a block boundary
+func alignDown(off int64) int64 {
+	return off / memfsBlockSize * memfsBlockSize
+}
+
+func alignUp(off int64) int64 {
+	if off > math.MaxInt64-memfsBlockSize {
+		return math.MaxInt64 / memfsBlockSize * memfsBlockSize
+	}
+	return alignDown(off + memfsBlockSize - 1)
+}
+
+// size returns the number of bytes allocated
+func (l extentList) size() int64 {
+	var n int64
+	for _, e := range l {
+		n += e.end - e.off
+	}
+	return n
+}
+
+// search returns the index of the first extent that ends after off
+func (l extentList) search(off int64) int {
+	return sort.Search(len(l), func(i int) bool { return l[i].end > off })
+}
+
+// missing returns the number of bytes that are not allocated in the blocks
+// covering range [off, end)
+func (l extentList) missing(off, end int64) int64 {
+	// An empty range covers no blocks, even within a block
+	if off >= end {
+		return 0
+	}
+	off, end = alignDown(off), alignUp(end)
+	if off >= end {
+		return 0
+	}
+	n := end - off
+	for i := l.search(off); i < len(l) && l[i].off < end; i++ {
+		n -= min64(l[i].end, end) - max64(l[i].off, off)
+	}
+	return n
+}
+
+// add allocates the blocks covering range [off, end)
+func (l *extentList) add(off, end int64) {
+	// An empty range covers no blocks, even within a block
+	if off >= end {
+		return
+	}
+	off, end = alignDown(off), alignUp(end)
+	if off >= end {
+		return
+	}
+	// Extents overlapping or adjacent to the range are merged into it
+	i := sort.Search(len(*l), func(i int) bool { return (*l)[i].end >= off })
+	j := i
+	for ; j < len(*l) && (*l)[j].off <= end; j++ {
+		off = min64(off, (*l)[j].off)
+		end = max64(end, (*l)[j].end)
+	}
+	res := append(extentList{}, (*l)[:i]...)
+	res = append(res, extent{off: off, end: end})
+	*l = append(res, (*l)[j:]...)
+}
+
+// remove deallocates the blocks fully covered by range [off, end)
+func (l *extentList) remove(off, end int64) {
+	off, end = alignUp(off), alignDown(end)
+	if off >= end {
+		return
+	}
+	res := make(extentList, 0, len(*l)+1)
+	for _, e := range *l {
+		if e.end <= off || e.off >= end {
+			res = append(res, e)
+			continue
+		}
+		if e.off < off {
+			res = append(res, extent{off: e.off, end: off})
+		}
+		if e.end > end {
+			res = append(res, extent{off: end, end: e.end})
+		}
+	}
+	*l = res
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
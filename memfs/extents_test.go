@@ -0,0 +1,83 @@
+package memfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+const bs = memfsBlockSize
+
+func TestExtentListAdd(t *testing.T) {
+	var l extentList
+	for _, tc := range []struct {
+		off, end int64
+		want     extentList
+	}{
+		// Ranges are extended to the blocks covering them
+		{100, 200, extentList{{0, bs}}},
+		{2 * bs, 3 * bs, extentList{{0, bs}, {2 * bs, 3 * bs}}},
+		// Adjacent extents are merged
+		{bs, 2 * bs, extentList{{0, 3 * bs}}},
+		{5*bs + 1, 6 * bs, extentList{{0, 3 * bs}, {5 * bs, 6 * bs}}},
+		// An empty range allocates nothing
+		{4 * bs, 4 * bs, extentList{{0, 3 * bs}, {5 * bs, 6 * bs}}},
+		{4*bs + 1, 4*bs + 1, extentList{{0, 3 * bs}, {5 * bs, 6 * bs}}},
+		// Overlapping extents are merged
+		{2*bs + 1, 7 * bs, extentList{{0, 7 * bs}}},
+		{bs, 2 * bs, extentList{{0, 7 * bs}}},
+	} {
+		l.add(tc.off, tc.end)
+		if !reflect.DeepEqual(l, tc.want) {
+			t.Fatalf("after add(%v, %v): got %v, want %v",
+				tc.off, tc.end, l, tc.want)
+		}
+	}
+	if l.size() != 7*bs {
+		t.Errorf("size: got %v, want %v", l.size(), 7*bs)
+	}
+}
+
+func TestExtentListRemove(t *testing.T) {
+	l := extentList{{0, 8 * bs}}
+	for _, tc := range []struct {
+		off, end int64
+		want     extentList
+	}{
+		// Blocks partially covered by the range are kept
+		{bs + 1, 2 * bs, extentList{{0, 8 * bs}}},
+		{bs, 3*bs - 1, extentList{{0, bs}, {2 * bs, 8 * bs}}},
+		{0, bs, extentList{{2 * bs, 8 * bs}}},
+		{7 * bs, 9 * bs, extentList{{2 * bs, 7 * bs}}},
+		{3 * bs, 4 * bs, extentList{{2 * bs, 3 * bs}, {4 * bs, 7 * bs}}},
+		{2 * bs, 2 * bs, extentList{{2 * bs, 3 * bs}, {4 * bs, 7 * bs}}},
+		{0, 10 * bs, extentList{}},
+	} {
+		l.remove(tc.off, tc.end)
+		if !reflect.DeepEqual(l, tc.want) {
+			t.Fatalf("after remove(%v, %v): got %v, want %v",
+				tc.off, tc.end, l, tc.want)
+		}
+	}
+}
+
+func TestExtentListMissing(t *testing.T) {
+	l := extentList{{bs, 2 * bs}, {3 * bs, 5 * bs}}
+	for _, tc := range []struct {
+		off, end int64
+		want     int64
+	}{
+		{0, bs, bs},
+		{0, 1, bs},
+		{bs, 2 * bs, 0},
+		{bs + 10, 2*bs - 10, 0},
+		{2*bs - 1, 3*bs + 1, bs},
+		{0, 6 * bs, 3 * bs},
+		{5 * bs, 5*bs + 1, bs},
+		{5, 5, 0},
+	} {
+		if got := l.missing(tc.off, tc.end); got != tc.want {
+			t.Errorf("missing(%v, %v): got %v, want %v",
+				tc.off, tc.end, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,1788 @@
+// Package memfs implements MemFS, a backend.BackendFS keeping everything in
+// memory.
+package memfs
+
+import (
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"fused/backend"
+
+	"fused/listmap"
+)
+
+// Limits of extended attributes, same as XATTR_NAME_MAX, XATTR_SIZE_MAX and
+// XATTR_LIST_MAX on Linux
+const (
+	xattrNameMax = 255
+	xattrSizeMax = 65536
+	xattrListMax = 65536
+)
+
+// Default limits of MemFS
+const (
+	memfsDefaultCapacity  = 4 << 30 // Bytes of file data
+	memfsDefaultMaxInodes = 1 << 20
+	memfsBlockSize        = 4096 // Block size reported by Statfs
+	memfsNameMax          = 255  // Maximum length of filenames
+)
+
+// MemFS is only changed through the mount, so the kernel may cache it for as
+// long as it wants
+const memfsCacheTimeout = 24 * time.Hour
+
+// This is a compile-time assertion to ensure that MemFS implements
+// backend.BackendFS interface
+var _ backend.BackendFS = (*MemFS)(nil)
+
+// This is a compile-time assertion to ensure that MemFS implements
+// backend.CacheAdviser interface
+var _ backend.CacheAdviser = (*MemFS)(nil)
+
+// This is a compile-time assertion to ensure that MemFS implements
+// backend.Seeker interface
+var _ backend.Seeker = (*MemFS)(nil)
+
+// This is a compile-time assertion to ensure that MemFS implements
+// backend.RangeCopier interface
+var _ backend.RangeCopier = (*MemFS)(nil)
+
+// NewMemFS returns an empty MemFS with the default limits
+func NewMemFS() *MemFS {
+	fs := &MemFS{
+		itable:      make(map[uint64]*memInode),
+		generations: make(map[uint64]uint64),
+		handles:     make(map[backend.HandleID]*memHandle),
+		locks:       backend.NewLockManager(),
+
+		// Next free ino, starting from 2
+		// 0 is resevred for indicating errors, 1 is ino of root directory
+		inoNextFree: 2,
+		inodes:      1,
+
+		Capacity:  memfsDefaultCapacity,
+		MaxInodes: memfsDefaultMaxInodes,
+	}
+	mode := os.ModeDir | 0777
+	fs.itable[1] = newMemInode(fs, nil, 1, mode, 0, 0)
+	return fs
+}
+
+func init() {
+	backend.Register(&backend.Backend{
+		Name:        "memfs",
+		Description: "keeps everything in memory, which is lost on unmount",
+		Options: []backend.Option{{
+			Name:        "capacity",
+			Type:        backend.OptionSize,
+			Description: "maximum bytes of file data",
+			Default:     strconv.FormatUint(memfsDefaultCapacity, 10),
+		}, {
+			Name:        "max_inodes",
+			Type:        backend.OptionUint,
+			Description: "maximum number of inodes",
+			Default:     strconv.FormatUint(memfsDefaultMaxInodes, 10),
+		}, {
+			Name:        "atime",
+			Type:        backend.OptionString,
+			Description: "when access times are updated on reads",
+			Default:     backend.Relatime.String(),
+			Choices: []string{backend.Relatime.String(),
+				backend.Strictatime.String(), backend.Noatime.String()},
+		}},
+		New: newFromOptions,
+	})
+}
+
+// newFromOptions creates a MemFS with options declared on registration
+func newFromOptions(opts *backend.Options) (backend.BackendFS, error) {
+	fs := NewMemFS()
+	fs.Capacity = opts.Uint("capacity")
+	fs.MaxInodes = opts.Uint("max_inodes")
+	atime, err := backend.ParseAtimePolicy(opts.String("atime"))
+	if err != nil {
+		return nil, err
+	}
+	fs.Atime = atime
+	return fs, nil
+}
+
+// MemFS is a filesystem keeping inodes and file data in memory. It is safe
+// for concurrent use.
+type MemFS struct {
+	// Capacity of the filesystem: maximum bytes of file data and maximum
+	// number of inodes. They should be set before the filesystem is used.
+	Capacity  uint64
+	MaxInodes uint64
+
+	// When the access time of a file is updated on reading it. It should be
+	// set before the filesystem is used.
+	Atime backend.AtimePolicy
+
+	// Renames are serialized, so that the tree of directories does not change
+	// while a rename checks it for loops
+	renameMu sync.Mutex
+
+	mu          sync.Mutex // protects the following fields
+	inoNextFree uint64
+	inoFree     []uint64 // Inode numbers released, to be reused
+	itable      map[uint64]*memInode
+
+	// Ino -> generation number of the inode using the number, or the last
+	// inode that used it. A number reused gets a new generation, so that
+	// (ino, generation) identifies an inode through the filesystem's life.
+	// Absent numbers are of generation 0.
+	generations map[uint64]uint64
+	inodes      uint64 // Number of inodes allocated
+	used        uint64 // Bytes of file data stored
+
+	// Open files
+	handles      map[backend.HandleID]*memHandle
+	handleNextID backend.HandleID
+
+	locks *backend.LockManager // Advisory locks of files
+}
+
+func (fs *MemFS) loadInode(ino uint64) (*memInode, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	inode, ok := fs.itable[ino]
+	return inode, ok
+}
+
+// removeInode removes an inode and releases its storage.
+// This method should be called with lock of the inode being held
+func (fs *MemFS) removeInode(ino uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if inode, ok := fs.itable[ino]; ok {
+		fs.used -= uint64(inode.alloc.size())
+		for _, block := range inode.blocks {
+			block.release()
+		}
+		fs.inodes--
+		fs.inoFree = append(fs.inoFree, ino)
+		delete(fs.itable, ino)
+	}
+}
+
+func (fs *MemFS) storeInode(
+	ino uint64, inode *memInode) *memInode {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.itable[ino] = inode
+	return inode
+}
+
+// generateIno allocates an inode number, reusing released numbers with a new
+// generation. It returns 0 if the number of inodes reaches the limit.
+func (fs *MemFS) generateIno() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.inodes >= fs.MaxInodes {
+		return 0
+	}
+	fs.inodes++
+	if n := len(fs.inoFree); n > 0 {
+		ino := fs.inoFree[n-1]
+		fs.inoFree = fs.inoFree[:n-1]
+		fs.generations[ino]++
+		return ino
+	}
+	ino := fs.inoNextFree
+	fs.inoNextFree++
+	return ino
+}
+
+// freeIno releases an inode number allocated by generateIno, which turns out
+// to be unused
+func (fs *MemFS) freeIno(ino uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.inodes--
+	fs.inoFree = append(fs.inoFree, ino)
+}
+
+// generation returns the generation number of inode number ino
+func (fs *MemFS) generation(ino uint64) uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.generations[ino]
+}
+
+// resize accounts for a change of file data from oldSize to newSize bytes. It
+// returns syscall.ENOSPC if there is no enough space for the change.
+func (fs *MemFS) resize(oldSize, newSize int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if newSize > oldSize && fs.used+uint64(newSize-oldSize) > fs.Capacity {
+		return syscall.ENOSPC
+	}
+	fs.used = fs.used + uint64(newSize) - uint64(oldSize)
+	return nil
+}
+
+func (fs *MemFS) Statfs(_ context.Context) (*backend.Statfs, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	blocks := fs.Capacity / memfsBlockSize
+	used := (fs.used + memfsBlockSize - 1) / memfsBlockSize
+	bfree := uint64(0)
+	if blocks > used {
+		bfree = blocks - used
+	}
+	ffree := uint64(0)
+	if fs.MaxInodes > fs.inodes {
+		ffree = fs.MaxInodes - fs.inodes
+	}
+	return &backend.Statfs{
+		Blocks:  blocks,
+		Bfree:   bfree,
+		Bavail:  bfree,
+		Files:   fs.MaxInodes,
+		Ffree:   ffree,
+		Bsize:   memfsBlockSize,
+		Namelen: memfsNameMax,
+	}, nil
+}
+
+func (fs *MemFS) Stat(_ context.Context, ino uint64) (*backend.Stat, error) {
+	return fs.stat(ino)
+}
+
+func (fs *MemFS) stat(ino uint64) (*backend.Stat, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.stat(), nil
+}
+
+// memHandle is the state of an open file in MemFS
+type memHandle struct {
+	ino   uint64
+	flags int // Open flags
+}
+
+// openHandle allocates a handle for an open file
+func (fs *MemFS) openHandle(ino uint64, flags int) backend.HandleID {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// Handle 0 is never used
+	fs.handleNextID++
+	fs.handles[fs.handleNextID] = &memHandle{ino: ino, flags: flags}
+	return fs.handleNextID
+}
+
+// loadHandle returns the inode of an open file and the state of the open
+// file, or syscall.EBADF if fh is not a handle of the inode.
+func (fs *MemFS) loadHandle(
+	ino uint64, fh backend.HandleID) (*memInode, *memHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	h, ok := fs.handles[fh]
+	if !ok || h.ino != ino {
+		return nil, nil, syscall.EBADF
+	}
+	inode, ok := fs.itable[ino]
+	if !ok {
+		return nil, nil, syscall.ENOENT
+	}
+	return inode, h, nil
+}
+
+func (fs *MemFS) closeHandle(fh backend.HandleID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.handles, fh)
+}
+
+func (fs *MemFS) Open(
+	_ context.Context, ino uint64, flags int) (backend.HandleID, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return 0, syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	inode.reference()
+	return fs.openHandle(ino, flags), nil
+}
+
+func (fs *MemFS) Create(_ context.Context, ino uint64, name string,
+	flags int, mode os.FileMode,
+	uid, gid uint32) (*backend.Stat, backend.HandleID, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, 0, syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	childIno, err := inode.addDirent(0, name, modeType(mode))
+	if err != nil {
+		return nil, 0, err
+	}
+	childInode := newMemInode(fs, inode, childIno, mode, uid, gid)
+	childInode.reference()
+	fs.storeInode(childIno, childInode)
+	return childInode.stat(), fs.openHandle(childIno, flags), nil
+}
+
+func (fs *MemFS) Mkdir(_ context.Context, ino uint64, name string,
+	mode os.FileMode, uid, gid uint32) (*backend.Stat, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	childIno, err := inode.addDirent(0, name, modeType(mode))
+	if err != nil {
+		return nil, err
+	}
+	childInode := newMemInode(fs, inode, childIno, mode, uid, gid)
+	fs.storeInode(childIno, childInode)
+	return childInode.stat(), nil
+}
+
+func (fs *MemFS) Mknod(_ context.Context, ino uint64, name string,
+	mode os.FileMode, rdev uint32, uid, gid uint32) (*backend.Stat, error) {
+	switch modeType(mode) {
+	case 0, os.ModeNamedPipe, os.ModeSocket,
+		os.ModeDevice, os.ModeDevice | os.ModeCharDevice:
+	default:
+		// Directories and symbolic links are created by Mkdir and Symlink
+		return nil, syscall.EINVAL
+	}
+
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	childIno, err := inode.addDirent(0, name, modeType(mode))
+	if err != nil {
+		return nil, err
+	}
+	childInode := newMemInode(fs, inode, childIno, mode, uid, gid)
+	if mode&os.ModeDevice != 0 {
+		childInode.rdev = rdev
+	}
+	fs.storeInode(childIno, childInode)
+	return childInode.stat(), nil
+}
+
+func (fs *MemFS) Rmdir(_ context.Context, ino uint64, name string) error {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.rmdir(name)
+}
+
+func (fs *MemFS) Unlink(_ context.Context, ino uint64, name string) error {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.unlink(name)
+}
+
+func (fs *MemFS) Rename(_ context.Context, sIno uint64, sName string,
+	dIno uint64, dName string, flags uint32) error {
+	const renameFlags = backend.RenameNoreplace | backend.RenameExchange |
+		backend.RenameWhiteout
+	if flags&^renameFlags != 0 ||
+		(flags&backend.RenameExchange != 0 && flags != backend.RenameExchange) {
+		return syscall.EINVAL
+	}
+
+	sInode, ok := fs.loadInode(sIno)
+	if !ok {
+		return syscall.ENOENT
+	}
+	dInode, ok := fs.loadInode(dIno)
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	fs.renameMu.Lock()
+	defer fs.renameMu.Unlock()
+
+	// A directory may not be moved into itself or its subdirectories, which
+	// would detach it from the tree. This is checked before the directories
+	// are locked, since it locks their ancestors.
+	if sIno != dIno {
+		if err := fs.checkLoop(sIno, sName, dIno); err != nil {
+			return err
+		}
+		if flags&backend.RenameExchange != 0 {
+			if err := fs.checkLoop(dIno, dName, sIno); err != nil {
+				return err
+			}
+		}
+	}
+
+	// nolint: gocritic
+	if sIno == dIno {
+		sInode.lock()
+		defer sInode.unlock()
+	} else if sIno < dIno {
+		sInode.lock()
+		defer sInode.unlock()
+		dInode.lock()
+		defer dInode.unlock()
+	} else {
+		dInode.lock()
+		defer dInode.unlock()
+		sInode.lock()
+		defer sInode.unlock()
+	}
+
+	sDirent, err := sInode.getDirent(sName)
+	if err != nil {
+		return err
+	}
+	dDirent, err := dInode.getDirent(dName)
+	if err != nil && err != syscall.ENOENT {
+		return err
+	}
+
+	if flags&backend.RenameExchange != 0 {
+		if err != nil {
+			return err
+		}
+		fs.exchange(sInode, sDirent, dInode, dDirent)
+		return nil
+	}
+	if err == nil && flags&backend.RenameNoreplace != 0 {
+		return syscall.EEXIST
+	}
+
+	if err != syscall.ENOENT && sDirent.Ino == dDirent.Ino {
+		// If oldpath(<sIno, sName>) and newpath(<dIno, dName>)
+		// are existing hard links referring to the same file,
+		// then rename does nothing, and returns a success status.
+		return nil
+	}
+
+	if err == nil {
+		if !sDirent.Type.IsDir() && dDirent.Type.IsDir() {
+			return syscall.EISDIR
+		}
+		if sDirent.Type.IsDir() && !dDirent.Type.IsDir() {
+			return syscall.ENOTDIR
+		}
+	}
+
+	var whiteout uint64
+	if flags&backend.RenameWhiteout != 0 {
+		// Allocated ahead so that the rename either completes or fails
+		// without any change
+		if whiteout = fs.generateIno(); whiteout == 0 {
+			return syscall.ENOSPC
+		}
+	}
+
+	if err == nil {
+		if dDirent.Type.IsDir() {
+			// An empty directory is replaced, otherwise ENOTEMPTY
+			err = dInode.rmdir(dName)
+		} else {
+			err = dInode.unlink(dName)
+		}
+		if err != nil {
+			if whiteout != 0 {
+				fs.freeIno(whiteout)
+			}
+			return err
+		}
+	}
+
+	// nolint: errcheck
+	dInode.addDirent(sDirent.Ino, dName, sDirent.Type)
+	// nolint: errcheck
+	sInode.removeDirent(sName)
+	if sDirent.Type.IsDir() && sIno != dIno {
+		fs.moveDir(sDirent.Ino, sInode, dInode)
+	}
+	fs.changed(sDirent.Ino)
+
+	if whiteout != 0 {
+		mode := os.ModeDevice | os.ModeCharDevice
+		// nolint: errcheck
+		sInode.addDirent(whiteout, sName, mode)
+		fs.storeInode(whiteout, newMemInode(fs, sInode, whiteout, mode, 0, 0))
+	}
+	return nil
+}
+
+// exchange exchanges directory entries sDirent in sInode and dDirent in
+// dInode. Locks of both directories should be held.
+// nolint: errcheck
+func (fs *MemFS) exchange(
+	sInode *memInode, sDirent *backend.Dirent,
+	dInode *memInode, dDirent *backend.Dirent) {
+	if sDirent.Ino == dDirent.Ino {
+		return
+	}
+	sInode.removeDirent(sDirent.Name)
+	dInode.removeDirent(dDirent.Name)
+	sInode.addDirent(dDirent.Ino, sDirent.Name, dDirent.Type)
+	dInode.addDirent(sDirent.Ino, dDirent.Name, sDirent.Type)
+
+	fs.changed(sDirent.Ino)
+	fs.changed(dDirent.Ino)
+
+	if sInode != dInode {
+		if sDirent.Type.IsDir() {
+			fs.moveDir(sDirent.Ino, sInode, dInode)
+		}
+		if dDirent.Type.IsDir() {
+			fs.moveDir(dDirent.Ino, dInode, sInode)
+		}
+	}
+}
+
+// moveDir updates the ".." entry of directory ino, which is moved from
+// directory from to directory to, as well as the link counts of them. Locks
+// of both directories should be held.
+func (fs *MemFS) moveDir(ino uint64, from, to *memInode) {
+	if inode, ok := fs.loadInode(ino); ok {
+		inode.mu.Lock()
+		inode.setParent(to.ino)
+		inode.mu.Unlock()
+	}
+	from.nlink--
+	to.nlink++
+}
+
+// changed updates the change time of inode ino, which is renamed. Locks of
+// the directories of the inode should be held.
+func (fs *MemFS) changed(ino uint64) {
+	if inode, ok := fs.loadInode(ino); ok {
+		inode.mu.Lock()
+		inode.ctime = time.Now()
+		inode.mu.Unlock()
+	}
+}
+
+// checkLoop returns syscall.EINVAL if the entry name in directory ino is a
+// directory, and it is dIno or an ancestor of dIno.
+// This method should be called with renameMu being held
+func (fs *MemFS) checkLoop(ino uint64, name string, dIno uint64) error {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return syscall.ENOENT
+	}
+	inode.mu.Lock()
+	dirent, err := inode.getDirent(name)
+	inode.mu.Unlock()
+	if err != nil || !dirent.Type.IsDir() {
+		// Errors are reported by the rename itself
+		return nil
+	}
+
+	dir := dIno
+	for dir != dirent.Ino {
+		inode, ok := fs.loadInode(dir)
+		if !ok {
+			return nil
+		}
+		inode.mu.Lock()
+		parent, err := inode.getDirent("..")
+		inode.mu.Unlock()
+		if err != nil || parent.Ino == dir {
+			// Reached the root directory
+			return nil
+		}
+		dir = parent.Ino
+	}
+	return syscall.EINVAL
+}
+
+func (fs *MemFS) Link(_ context.Context,
+	ino uint64, dIno uint64, dName string) (*backend.Stat, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	dInode, ok := fs.loadInode(dIno)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	// assert ino != dIno
+	// assert inode.mode & os.ModeType == 0
+	// assert dInode.mode & os.ModeType == os.ModeDir
+
+	inode.lock()
+	defer inode.unlock()
+	dInode.lock()
+	defer dInode.unlock()
+
+	if _, err := dInode.getDirent(dName); err == nil {
+		return nil, syscall.EEXIST
+	}
+	// nolint: errcheck
+	dInode.addDirent(ino, dName, inode.mode&os.ModeType)
+
+	inode.link()
+
+	return inode.stat(), nil
+}
+
+func (fs *MemFS) Symlink(_ context.Context, ino uint64, name string,
+	target string, uid, gid uint32) (*backend.Stat, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	mode := os.ModeSymlink | 0777
+	childIno, err := inode.addDirent(0, name, modeType(mode))
+	if err != nil {
+		return nil, err
+	}
+	childInode := newMemInode(fs, inode, childIno, mode, uid, gid)
+	childInode.target = target
+	fs.storeInode(childIno, childInode)
+	return childInode.stat(), nil
+}
+
+func (fs *MemFS) Readlink(_ context.Context, ino uint64) (string, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return "", syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.readlink()
+}
+
+func (fs *MemFS) Setattr(
+	_ context.Context,
+	ino uint64, req *backend.SetattrRequest) (*backend.Stat, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	if req.Valid&backend.SetattrHandle != 0 {
+		if _, _, err := fs.loadHandle(ino, req.Handle); err != nil {
+			return nil, err
+		}
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.setattr(req)
+}
+
+func (fs *MemFS) Getxattr(
+	_ context.Context, ino uint64, name string) ([]byte, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.getxattr(name)
+}
+
+func (fs *MemFS) Listxattr(
+	_ context.Context, ino uint64) ([]string, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.listxattr(), nil
+}
+
+func (fs *MemFS) Setxattr(_ context.Context,
+	ino uint64, name string, value []byte, flags uint32) error {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.setxattr(name, value, flags)
+}
+
+func (fs *MemFS) Removexattr(
+	_ context.Context, ino uint64, name string) error {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.removexattr(name)
+}
+
+func (fs *MemFS) Lookup(
+	_ context.Context, ino uint64, name string) (*backend.Stat, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.lookup(name)
+}
+
+func (fs *MemFS) Readdir(_ context.Context,
+	ino uint64, marker string, n int) ([]backend.Dirent, string, error) {
+	inode, ok := fs.loadInode(ino)
+	if !ok {
+		return nil, "", syscall.ENOENT
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.readdir(marker, n)
+}
+
+func (fs *MemFS) Read(_ context.Context,
+	ino uint64, fh backend.HandleID, offset int64, n int) ([]byte, error) {
+	inode, _, err := fs.loadHandle(ino, fh)
+	if err != nil {
+		return nil, err
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.read(offset, n)
+}
+
+func (fs *MemFS) Write(_ context.Context,
+	ino uint64, fh backend.HandleID, offset int64, data []byte) (int, error) {
+	inode, h, err := fs.loadHandle(ino, fh)
+	if err != nil {
+		return 0, err
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	if h.flags&syscall.O_APPEND != 0 {
+		// Data is always appended to the end of file, which is atomic since
+		// the inode is locked
+		offset = inode.size
+	}
+	return inode.write(offset, data)
+}
+
+func (fs *MemFS) Lseek(_ context.Context,
+	ino uint64, fh backend.HandleID, offset int64, whence int) (int64, error) {
+	inode, _, err := fs.loadHandle(ino, fh)
+	if err != nil {
+		return 0, err
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.lseek(offset, whence)
+}
+
+func (fs *MemFS) CopyFileRange(_ context.Context,
+	ino uint64, fh backend.HandleID, offset int64,
+	dIno uint64, dFh backend.HandleID,
+	dOffset int64, length int64) (int64, error) {
+	inode, h, err := fs.loadHandle(ino, fh)
+	if err != nil {
+		return 0, err
+	}
+	dInode, dH, err := fs.loadHandle(dIno, dFh)
+	if err != nil {
+		return 0, err
+	}
+	if h.flags&syscall.O_ACCMODE == syscall.O_WRONLY ||
+		dH.flags&syscall.O_ACCMODE == syscall.O_RDONLY ||
+		dH.flags&syscall.O_APPEND != 0 {
+		return 0, syscall.EBADF
+	}
+
+	// nolint: gocritic
+	if ino == dIno {
+		inode.lock()
+		defer inode.unlock()
+	} else if ino < dIno {
+		inode.lock()
+		defer inode.unlock()
+		dInode.lock()
+		defer dInode.unlock()
+	} else {
+		dInode.lock()
+		defer dInode.unlock()
+		inode.lock()
+		defer inode.unlock()
+	}
+
+	return dInode.copyRange(inode, offset, dOffset, length)
+}
+
+func (fs *MemFS) Fallocate(_ context.Context,
+	ino uint64, fh backend.HandleID, offset, length int64, mode uint32) error {
+	inode, _, err := fs.loadHandle(ino, fh)
+	if err != nil {
+		return err
+	}
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.fallocate(offset, length, mode)
+}
+
+func (fs *MemFS) Fsync(_ context.Context,
+	ino uint64, fh backend.HandleID, datasync uint32, dir bool) error {
+	if fh == 0 {
+		if _, ok := fs.loadInode(ino); !ok {
+			return syscall.ENOENT
+		}
+		return nil
+	}
+	_, _, err := fs.loadHandle(ino, fh)
+	return err
+}
+
+func (fs *MemFS) Flush(
+	_ context.Context, ino uint64, fh backend.HandleID) error {
+	_, _, err := fs.loadHandle(ino, fh)
+	return err
+}
+
+func (fs *MemFS) Getlk(
+	_ context.Context,
+	ino uint64, lk *backend.FileLock) (*backend.FileLock, error) {
+	if _, ok := fs.loadInode(ino); !ok {
+		return nil, syscall.ENOENT
+	}
+	return fs.locks.Getlk(ino, lk), nil
+}
+
+func (fs *MemFS) Setlk(
+	ctx context.Context, ino uint64, lk *backend.FileLock, wait bool) error {
+	if _, ok := fs.loadInode(ino); !ok {
+		return syscall.ENOENT
+	}
+	return fs.locks.Setlk(ctx, ino, lk, wait)
+}
+
+func (fs *MemFS) Flock(ctx context.Context,
+	ino uint64, owner uint64, typ backend.LockType, wait bool) error {
+	if _, ok := fs.loadInode(ino); !ok {
+		return syscall.ENOENT
+	}
+	return fs.locks.Flock(ctx, ino, owner, typ, wait)
+}
+
+func (fs *MemFS) Release(
+	_ context.Context, ino uint64, fh backend.HandleID, flags int) error {
+	inode, _, err := fs.loadHandle(ino, fh)
+	if err != nil {
+		return err
+	}
+	fs.closeHandle(fh)
+
+	inode.lock()
+	defer inode.unlock()
+
+	return inode.release()
+}
+
+// CacheConfig lets the kernel cache attributes, names and data of MemFS,
+// which are only changed through the mount
+func (fs *MemFS) CacheConfig() backend.CacheConfig {
+	return backend.CacheConfig{
+		AttrTimeout:  memfsCacheTimeout,
+		EntryTimeout: memfsCacheTimeout,
+		KeepCache:    true,
+	}
+}
+
+// Close releases all the inodes, whose contents are lost since MemFS keeps
+// nothing beyond the mount
+func (fs *MemFS) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.itable = make(map[uint64]*memInode)
+	fs.handles = make(map[backend.HandleID]*memHandle)
+	fs.inodes = 0
+	fs.used = 0
+	return nil
+}
+
+type memInode struct {
+	fs *MemFS
+
+	ino        uint64
+	generation uint64 // Generation number, see MemFS.generations
+
+	mu sync.Mutex // Lock protecting the following fields
+
+	// Number of hard links: 0 or 1 in current implementation
+	nlink uint32
+
+	// Reference counter, also number of open file handles that point to this
+	// inode.
+	// Generally, this is a field of in-core inodes. Disk inodes do not have
+	// this field
+	count uint32
+
+	mode os.FileMode
+	uid  uint32 // User ID of owner
+	gid  uint32 // Group ID of owner
+	rdev uint32 // Device number of a character or block special file
+
+	// Note that distinction between writing contents of an inode to storage
+	// and writing the contents of a file to storage. The contents of a file
+	// change only when writing it. The contents of inode change when changing
+	// the contents of a file or when changing its owner, permission, or link
+	// settings. Changing the contents of a file implies a change to the inode,
+	// but not vise versa.
+	//           -- Book: Design of the Unix Operating System By Maurice Bach
+	//
+	// Note that ctime always >= mtime. atime is only updated when the data
+	// is read, as the atime policy of the filesystem allows.
+	atime  time.Time
+	mtime  time.Time
+	ctime  time.Time
+	crtime time.Time
+
+	// Entries of a directory: name -> *dirEntry, and the directory log, which
+	// holds the entries ordered by their sequence numbers, including removed
+	// entries that have not been compacted
+	dirents *listmap.ListMap
+	dirlog  []*dirEntry
+	dirseq  uint64 // Sequence number of the last entry added
+	dirdead int    // Number of removed entries in dirlog
+
+	// Data of a regular file, which is stored sparsely: block index -> data
+	// of the block. Blocks not stored are read as zeros.
+	size   int64
+	blocks map[int64]*memBlock
+	alloc  extentList // Blocks allocated to data, which may exceed its size
+	target string     // Target of a symbolic link
+
+	xattrs     *listmap.ListMap // Extended attributes: name -> value
+	xattrsSize int              // Size of the list of extended attribute names
+}
+
+// newMemInode creates an inode owned by uid and gid. If parent is a
+// set-group-ID directory, the inode inherits the group of parent instead,
+// and a directory inherits the set-group-ID bit as well.
+// nolint: errcheck
+func newMemInode(fs *MemFS, parent *memInode, ino uint64, mode os.FileMode,
+	uid, gid uint32) *memInode {
+	if parent != nil && parent.mode&os.ModeSetgid != 0 {
+		gid = parent.gid
+		if mode&os.ModeDir != 0 {
+			mode |= os.ModeSetgid
+		}
+	}
+
+	crtime := time.Now()
+	inode := &memInode{
+		fs: fs,
+
+		ino:        ino,
+		generation: fs.generation(ino),
+		nlink:      1,
+		count:      0,
+		mode:       mode,
+		uid:        uid,
+		gid:        gid,
+		atime:      crtime,
+		mtime:      crtime,
+		ctime:      crtime,
+		crtime:     crtime,
+
+		dirents: listmap.NewListMap(),
+		blocks:  make(map[int64]*memBlock),
+		xattrs:  listmap.NewListMap(),
+	}
+
+	if mode&os.ModeDir != 0 {
+		inode.addDirent(ino, ".", modeType(mode))
+		inode.nlink++
+		if parent != nil {
+			inode.addDirent(parent.ino, "..", modeType(parent.mode))
+			parent.nlink++
+		} else { // Root directory
+			inode.addDirent(ino, "..", modeType(mode))
+		}
+	}
+
+	return inode
+}
+
+func (inode *memInode) lock() {
+	inode.mu.Lock()
+}
+
+func (inode *memInode) unlock() {
+	inode.mu.Unlock()
+}
+
+func (inode *memInode) reference() {
+	inode.count++
+}
+
+func (inode *memInode) link() {
+	inode.nlink++
+	inode.ctime = time.Now()
+}
+
+// access updates the access time of the inode, whose data is read, as the
+// atime policy of the filesystem requires
+func (inode *memInode) access() {
+	now := time.Now()
+	if inode.fs.Atime.ShouldUpdate(
+		inode.atime, inode.mtime, inode.ctime, now) {
+		inode.atime = now
+	}
+}
+
+func (inode *memInode) addDirent(
+	ino uint64, name string, t os.FileMode) (uint64, error) {
+	if len(name) > memfsNameMax {
+		return 0, syscall.ENAMETOOLONG
+	}
+	dirent := inode.dirents.Get(name)
+	if dirent != nil {
+		return 0, syscall.EEXIST
+	}
+
+	if ino == 0 {
+		if ino = inode.fs.generateIno(); ino == 0 {
+			return 0, syscall.ENOSPC
+		}
+	}
+
+	inode.dirseq++
+	entry := &dirEntry{
+		Dirent: backend.Dirent{Ino: ino, Name: name, Type: t},
+		seq:    inode.dirseq,
+	}
+	inode.dirents.Put(name, entry)
+	inode.dirlog = append(inode.dirlog, entry)
+
+	inode.mtime = time.Now()
+	inode.ctime = inode.mtime
+	return ino, nil
+}
+
+func (inode *memInode) getDirent(name string) (*backend.Dirent, error) {
+	dirent := inode.dirents.Get(name)
+	if dirent == nil {
+		return nil, syscall.ENOENT
+	}
+	return &dirent.(*dirEntry).Dirent, nil
+}
+
+// setParent points the ".." entry of a directory to directory parent. The
+// entry keeps its position in the directory.
+func (inode *memInode) setParent(parent uint64) {
+	if entry := inode.dirents.Get(".."); entry != nil {
+		entry.(*dirEntry).Ino = parent
+	}
+	inode.ctime = time.Now()
+}
+
+func (inode *memInode) removeDirent(name string) (uint64, error) {
+	ino, err := inode.deleteDirent(name)
+	if err != nil {
+		return 0, err
+	}
+
+	inode.mtime = time.Now()
+	inode.ctime = inode.mtime
+	return ino, nil
+}
+
+// deleteDirent removes an entry from the directory without updating times
+func (inode *memInode) deleteDirent(name string) (uint64, error) {
+	dirent := inode.dirents.Get(name)
+	if dirent == nil {
+		return 0, syscall.ENOENT
+	}
+	inode.dirents.Delete(name)
+
+	// Removed entries are kept in the directory log until they make up
+	// the most of it, so that positions of the remaining entries stay valid
+	// for readers without moving the log on every removal
+	entry := dirent.(*dirEntry)
+	entry.removed = true
+	inode.dirdead++
+	if inode.dirdead > 32 && inode.dirdead > len(inode.dirlog)/2 {
+		dirlog := make([]*dirEntry, 0, len(inode.dirlog)-inode.dirdead)
+		for _, e := range inode.dirlog {
+			if !e.removed {
+				dirlog = append(dirlog, e)
+			}
+		}
+		inode.dirlog = dirlog
+		inode.dirdead = 0
+	}
+	return entry.Ino, nil
+}
+
+func (inode *memInode) setattr(
+	req *backend.SetattrRequest) (*backend.Stat, error) {
+	if req.Valid&backend.SetattrSize != 0 && inode.mode&os.ModeDir != 0 {
+		return nil, syscall.EISDIR
+	}
+	if req.Valid&backend.SetattrSize != 0 && req.Size > math.MaxInt64 {
+		return nil, syscall.EFBIG
+	}
+
+	if req.Valid&backend.SetattrMode != 0 {
+		inode.mode = req.Mode
+		inode.ctime = time.Now()
+	}
+
+	if req.Valid&(backend.SetattrUID|backend.SetattrGID) != 0 {
+		if req.Valid&backend.SetattrUID != 0 {
+			inode.uid = req.UID
+		}
+		if req.Valid&backend.SetattrGID != 0 {
+			inode.gid = req.GID
+		}
+		if inode.mode&os.ModeDir == 0 {
+			// Changing the owner or group of an executable file clears its
+			// set-user-ID bit, as well as its set-group-ID bit if the group
+			// execute bit is set (otherwise it indicates mandatory locking)
+			inode.mode &^= os.ModeSetuid
+			if inode.mode&0010 != 0 {
+				inode.mode &^= os.ModeSetgid
+			}
+		}
+		inode.ctime = time.Now()
+	}
+
+	if req.Valid&backend.SetattrAtime != 0 {
+		inode.atime = req.Atime
+		inode.ctime = time.Now()
+	}
+
+	if req.Valid&backend.SetattrMtime != 0 {
+		inode.mtime = req.Mtime
+		inode.ctime = time.Now()
+	}
+
+	if req.Valid&backend.SetattrSize != 0 {
+		size := int64(req.Size)
+		if size < inode.size {
+			// Blocks beyond the end of file are freed, including those
+			// preallocated by Fallocate. Extending a file leaves a hole.
+			inode.zero(size, math.MaxInt64)
+			inode.deallocate(size, math.MaxInt64)
+		}
+		inode.size = size
+		inode.mtime = time.Now()
+		inode.ctime = inode.mtime
+	}
+
+	if req.Valid&backend.SetattrCtime != 0 {
+		inode.ctime = req.Ctime
+	}
+
+	return inode.stat(), nil
+}
+
+func (inode *memInode) getxattr(name string) ([]byte, error) {
+	if err := checkXattrName(name); err != nil {
+		return nil, err
+	}
+	value := inode.xattrs.Get(name)
+	if value == nil {
+		return nil, syscall.ENODATA
+	}
+	return append([]byte(nil), value.([]byte)...), nil
+}
+
+func (inode *memInode) listxattr() []string {
+	names := make([]string, 0, inode.xattrs.Len())
+	for _, name := range inode.xattrs.Keys() {
+		names = append(names, name.(string))
+	}
+	return names
+}
+
+func (inode *memInode) setxattr(
+	name string, value []byte, flags uint32) error {
+	if err := checkXattrName(name); err != nil {
+		return err
+	}
+	if len(value) > xattrSizeMax {
+		return syscall.E2BIG
+	}
+	if strings.HasPrefix(name, "user.") &&
+		inode.mode&os.ModeType&^os.ModeDir != 0 {
+		// User extended attributes are only allowed for regular files and
+		// directories, see xattr(7)
+		return syscall.EPERM
+	}
+
+	exists := inode.xattrs.Contains(name)
+	if flags&backend.XattrCreate != 0 && exists {
+		return syscall.EEXIST
+	}
+	if flags&backend.XattrReplace != 0 && !exists {
+		return syscall.ENODATA
+	}
+	if !exists {
+		// Each name in the list is terminated by a null byte
+		if inode.xattrsSize+len(name)+1 > xattrListMax {
+			return syscall.ENOSPC
+		}
+		inode.xattrsSize += len(name) + 1
+	}
+
+	inode.xattrs.Put(name, append([]byte(nil), value...))
+	inode.ctime = time.Now()
+	return nil
+}
+
+func (inode *memInode) removexattr(name string) error {
+	if err := checkXattrName(name); err != nil {
+		return err
+	}
+	if !inode.xattrs.Contains(name) {
+		return syscall.ENODATA
+	}
+	inode.xattrs.Delete(name)
+	inode.xattrsSize -= len(name) + 1
+	inode.ctime = time.Now()
+	return nil
+}
+
+// checkXattrName checks whether name is a valid name of an extended attribute
+// supported by MemFS
+func checkXattrName(name string) error {
+	if len(name) > xattrNameMax {
+		return syscall.ERANGE
+	}
+	for _, ns := range []string{"user.", "trusted.", "security."} {
+		if strings.HasPrefix(name, ns) && len(name) > len(ns) {
+			return nil
+		}
+	}
+	// Names without a namespace prefix are invalid. The "system." namespace
+	// is used for kernel objects such as ACLs, which are not supported.
+	return syscall.EOPNOTSUPP
+}
+
+func (inode *memInode) lookup(name string) (*backend.Stat, error) {
+	dirent := inode.dirents.Get(name)
+	if dirent == nil {
+		return nil, syscall.ENOENT
+	}
+	return inode.fs.stat(dirent.(*dirEntry).Ino)
+}
+
+func (inode *memInode) rmdir(name string) error {
+	dirent := inode.dirents.Get(name)
+	if dirent == nil {
+		return syscall.ENOENT
+	}
+
+	if dirent.(*dirEntry).Type&os.ModeDir == 0 {
+		return syscall.ENOTDIR
+	}
+
+	child, _ := inode.fs.loadInode(dirent.(*dirEntry).Ino)
+	child.lock()
+	defer child.unlock()
+
+	if child.mode&os.ModeDir != 0 && child.dirents.Len() > 2 {
+		// The directory contains entries other than . and ..
+		return syscall.ENOTEMPTY
+	}
+	_, _ = child.deleteDirent("..")
+	inode.nlink--
+	_, _ = child.deleteDirent(".")
+	child.nlink--
+	return inode.doRemove(child, name)
+}
+
+func (inode *memInode) unlink(name string) error {
+	dirent := inode.dirents.Get(name)
+	if dirent == nil {
+		return syscall.ENOENT
+	}
+
+	child, _ := inode.fs.loadInode(dirent.(*dirEntry).Ino)
+	child.lock()
+	defer child.unlock()
+	return inode.doRemove(child, name)
+}
+
+func (inode *memInode) doRemove(child *memInode, name string) error {
+	_, _ = inode.removeDirent(name)
+
+	if child.nlink == 0 {
+		log.Println("(*memInode).doRemove: nlink is already 0")
+	} else {
+		child.nlink--
+		child.ctime = time.Now()
+	}
+
+	if child.nlink == 0 && child.count == 0 {
+		inode.fs.removeInode(child.ino)
+		return nil
+	}
+	return nil
+}
+
+// readdir returns up to n Dirent in a directory after the position indicated
+// by marker, see backend.BackendFS.Readdir.
+//
+// A marker is the sequence number of a directory entry. Entries are assigned
+// increasing sequence numbers as they are added, so a marker stays valid
+// when entries are added or removed: entries added after the marker is
+// generated are returned, and entries removed are not.
+func (inode *memInode) readdir(
+	marker string, n int) ([]backend.Dirent, string, error) {
+	var after uint64
+	if len(marker) > 0 {
+		var err error
+		if after, err = strconv.ParseUint(marker, 10, 64); err != nil {
+			return nil, "", syscall.EINVAL
+		}
+	}
+
+	inode.access()
+
+	i := sort.Search(len(inode.dirlog), func(i int) bool {
+		return inode.dirlog[i].seq > after
+	})
+	res := make([]backend.Dirent, 0)
+	for ; i < len(inode.dirlog); i++ {
+		entry := inode.dirlog[i]
+		if entry.removed {
+			continue
+		}
+		if n > 0 && len(res) == n {
+			return res, res[n-1].Marker, nil
+		}
+		dirent := entry.Dirent
+		dirent.Marker = strconv.FormatUint(entry.seq, 10)
+		res = append(res, dirent)
+	}
+	return res, "", nil
+}
+
+func (inode *memInode) readlink() (string, error) {
+	if inode.mode&os.ModeSymlink == 0 {
+		return "", syscall.EINVAL
+	}
+	inode.access()
+	return inode.target, nil
+}
+
+// read reads up to n bytes starting at offset. Holes are read as zeros.
+func (inode *memInode) read(offset int64, n int) ([]byte, error) {
+	if offset < 0 {
+		return nil, syscall.EINVAL
+	}
+	inode.access()
+	if offset >= inode.size {
+		return []byte{}, nil
+	}
+
+	end := inode.size
+	if n > 0 && int64(n) < end-offset {
+		end = offset + int64(n)
+	}
+	buff := make([]byte, end-offset)
+	for off := offset; off < end; {
+		i, start := off/memfsBlockSize, off%memfsBlockSize
+		cnt := min64(memfsBlockSize-start, end-off)
+		if block, ok := inode.blocks[i]; ok {
+			copy(buff[off-offset:off-offset+cnt], block.data[start:])
+		}
+		off += cnt
+	}
+	return buff, nil
+}
+
+// write writes data at offset. Only the blocks written are allocated, so a
+// gap between the end of file and offset becomes a hole.
+func (inode *memInode) write(offset int64, data []byte) (int, error) {
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	if offset > math.MaxInt64-int64(len(data)) {
+		return 0, syscall.EFBIG
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	end := offset + int64(len(data))
+	if err := inode.allocate(offset, end); err != nil {
+		return 0, err
+	}
+	for off := offset; off < end; {
+		i, start := off/memfsBlockSize, off%memfsBlockSize
+		block := inode.writableBlock(i)
+		off += int64(copy(block[start:], data[off-offset:]))
+	}
+	if end > inode.size {
+		inode.size = end
+	}
+
+	inode.mtime = time.Now()
+	inode.ctime = inode.mtime
+	return len(data), nil
+}
+
+// lseek returns the offset of the next data (whence is SeekData) or hole
+// (whence is SeekHole) at or after offset. Blocks allocated by Fallocate
+// are data. There is an implicit hole at the end of file.
+func (inode *memInode) lseek(offset int64, whence int) (int64, error) {
+	if whence != backend.SeekData && whence != backend.SeekHole {
+		return 0, syscall.EINVAL
+	}
+	if offset < 0 || offset >= inode.size {
+		return 0, syscall.ENXIO
+	}
+
+	i := inode.alloc.search(offset)
+	if whence == backend.SeekData {
+		if i == len(inode.alloc) || inode.alloc[i].off >= inode.size {
+			return 0, syscall.ENXIO
+		}
+		return max64(offset, inode.alloc[i].off), nil
+	}
+	if i == len(inode.alloc) || inode.alloc[i].off > offset {
+		return offset, nil
+	}
+	return min64(inode.alloc[i].end, inode.size), nil
+}
+
+// fallocate manipulates the space allocated to range [offset, offset+length)
+// of the file as mode requests, see fallocate(2)
+func (inode *memInode) fallocate(offset, length int64, mode uint32) error {
+	if offset < 0 || length <= 0 {
+		return syscall.EINVAL
+	}
+	if offset > math.MaxInt64-length {
+		return syscall.EFBIG
+	}
+	if inode.mode.IsDir() {
+		return syscall.EISDIR
+	}
+	if !inode.mode.IsRegular() {
+		return syscall.ENODEV
+	}
+
+	end := offset + length
+	extend := mode&backend.FallocKeepSize == 0 && end > inode.size
+
+	switch mode &^ backend.FallocKeepSize {
+	case 0:
+		if err := inode.allocate(offset, end); err != nil {
+			return err
+		}
+	case backend.FallocPunchHole:
+		// Punching a hole never changes the file size
+		if mode&backend.FallocKeepSize == 0 {
+			return syscall.EOPNOTSUPP
+		}
+		inode.zero(offset, end)
+		inode.deallocate(offset, end)
+	case backend.FallocZeroRange:
+		if err := inode.allocate(offset, end); err != nil {
+			return err
+		}
+		inode.zero(offset, end)
+	default:
+		return syscall.EOPNOTSUPP
+	}
+
+	if extend {
+		inode.size = end
+	}
+	if extend || mode&(backend.FallocPunchHole|backend.FallocZeroRange) != 0 {
+		inode.mtime = time.Now()
+		inode.ctime = inode.mtime
+	}
+	return nil
+}
+
+// allocate allocates the blocks covering range [off, end) of file data. It
+// returns syscall.ENOSPC if there is no enough space.
+func (inode *memInode) allocate(off, end int64) error {
+	size := inode.alloc.size()
+	n := inode.alloc.missing(off, end)
+	if err := inode.fs.resize(int(size), int(size+n)); err != nil {
+		return err
+	}
+	inode.alloc.add(off, end)
+	return nil
+}
+
+// deallocate frees the blocks fully covered by range [off, end) of file data
+// nolint: errcheck
+func (inode *memInode) deallocate(off, end int64) {
+	size := inode.alloc.size()
+	inode.alloc.remove(off, end)
+	inode.fs.resize(int(size), int(inode.alloc.size()))
+}
+
+// zero fills range [off, end) of file data with zeros. Blocks fully covered
+// by the range are dropped, which are read as zeros as well.
+func (inode *memInode) zero(off, end int64) {
+	if off >= end {
+		return
+	}
+	first, last := off/memfsBlockSize, (end-1)/memfsBlockSize
+	if last-first < int64(len(inode.blocks)) {
+		for i := first; i <= last; i++ {
+			if _, ok := inode.blocks[i]; ok {
+				inode.zeroBlock(i, off, end)
+			}
+		}
+		return
+	}
+	for i := range inode.blocks {
+		if first <= i && i <= last {
+			inode.zeroBlock(i, off, end)
+		}
+	}
+}
+
+// zeroBlock fills the part of block i in range [off, end) with zeros
+func (inode *memInode) zeroBlock(i int64, off, end int64) {
+	bOff := i * memfsBlockSize
+	if off <= bOff && bOff+memfsBlockSize <= end {
+		inode.blocks[i].release()
+		delete(inode.blocks, i)
+		return
+	}
+	block := inode.writableBlock(i)
+	start, stop := max64(off-bOff, 0), min64(end-bOff, memfsBlockSize)
+	for j := start; j < stop; j++ {
+		block[j] = 0
+	}
+}
+
+// writableBlock returns data of block i for writing. A missing block is
+// created, and a block shared with other files is copied first.
+func (inode *memInode) writableBlock(i int64) []byte {
+	block, ok := inode.blocks[i]
+	if !ok {
+		block = newMemBlock()
+		inode.blocks[i] = block
+	} else if block.shared() {
+		copied := newMemBlock()
+		copied.data = block.data
+		block.release()
+		block = copied
+		inode.blocks[i] = block
+	}
+	return block.data[:]
+}
+
+// copyRange copies length bytes of data from offset of file src to dOffset
+// of the file, returning the number of bytes copied. Blocks in the same
+// position within the source and destination are shared rather than copied.
+// Shared blocks are still accounted to both files, so that copying them on
+// write never runs out of space. Locks of both files should be held.
+func (inode *memInode) copyRange(
+	src *memInode, offset, dOffset, length int64) (int64, error) {
+	if offset < 0 || dOffset < 0 || length < 0 {
+		return 0, syscall.EINVAL
+	}
+	if dOffset > math.MaxInt64-length {
+		return 0, syscall.EFBIG
+	}
+	if src.mode.IsDir() || inode.mode.IsDir() {
+		return 0, syscall.EISDIR
+	}
+	if !src.mode.IsRegular() || !inode.mode.IsRegular() {
+		return 0, syscall.EINVAL
+	}
+	src.access()
+	if offset >= src.size {
+		return 0, nil
+	}
+	length = min64(length, src.size-offset)
+	if src == inode && offset < dOffset+length && dOffset < offset+length {
+		// Overlapping ranges of the same file
+		return 0, syscall.EINVAL
+	}
+	if length == 0 {
+		return 0, nil
+	}
+
+	if err := inode.allocate(dOffset, dOffset+length); err != nil {
+		return 0, err
+	}
+	for n := int64(0); n < length; {
+		sOff, dOff := offset+n, dOffset+n
+		si, sStart := sOff/memfsBlockSize, sOff%memfsBlockSize
+		di, dStart := dOff/memfsBlockSize, dOff%memfsBlockSize
+		block, ok := src.blocks[si]
+
+		if sStart == 0 && dStart == 0 && length-n >= memfsBlockSize {
+			// Whole block
+			if old, ok := inode.blocks[di]; ok {
+				old.release()
+				delete(inode.blocks, di)
+			}
+			if ok {
+				block.share()
+				inode.blocks[di] = block
+			}
+			n += memfsBlockSize
+			continue
+		}
+
+		cnt := min64(memfsBlockSize-max64(sStart, dStart), length-n)
+		if ok {
+			copy(inode.writableBlock(di)[dStart:dStart+cnt],
+				block.data[sStart:sStart+cnt])
+		} else {
+			inode.zero(dOff, dOff+cnt)
+		}
+		n += cnt
+	}
+
+	if dOffset+length > inode.size {
+		inode.size = dOffset + length
+	}
+	inode.mtime = time.Now()
+	inode.ctime = inode.mtime
+	return length, nil
+}
+
+func (inode *memInode) release() error {
+	if inode.count > 0 {
+		inode.count--
+	}
+	if inode.nlink == 0 && inode.count == 0 {
+		inode.fs.removeInode(inode.ino)
+	}
+	return nil
+}
+
+func (inode *memInode) stat() *backend.Stat {
+	size := uint64(inode.size)
+	if inode.mode&os.ModeSymlink != 0 {
+		// The size of a symbolic link is the length of the pathname it
+		// contains, without a terminating null byte
+		size = uint64(len(inode.target))
+	}
+	return &backend.Stat{
+		Ino:        inode.ino,
+		Generation: inode.generation,
+		Mode:       inode.mode,
+		Nlink:      inode.nlink,
+		UID:        inode.uid,
+		GID:        inode.gid,
+		Rdev:       inode.rdev,
+		Size:       size,
+		BlockSize:  512,
+		Blocks:     uint64(inode.alloc.size()) / 512,
+		Atime:      inode.atime,
+		Mtime:      inode.mtime,
+		Ctime:      inode.ctime,
+		Crtime:     inode.crtime,
+	}
+}
+
+// memBlock is a block of file data, which may be shared by files
+// copy-on-write after copyRange
+type memBlock struct {
+	data [memfsBlockSize]byte
+
+	// Number of files referring to the block, updated atomically since files
+	// are locked separately. It is increased only with the lock of a file
+	// referring to the block held, so a file seeing 1 owns the block.
+	refs int32
+}
+
+func newMemBlock() *memBlock {
+	return &memBlock{refs: 1}
+}
+
+func (b *memBlock) share() {
+	atomic.AddInt32(&b.refs, 1)
+}
+
+func (b *memBlock) shared() bool {
+	return atomic.LoadInt32(&b.refs) > 1
+}
+
+func (b *memBlock) release() {
+	atomic.AddInt32(&b.refs, -1)
+}
+
+// dirEntry is an entry of a directory in MemFS
+type dirEntry struct {
+	backend.Dirent
+	seq     uint64 // Sequence number, increasing in order of addition
+	removed bool
+}
+
+func modeType(mode os.FileMode) os.FileMode {
+	return mode & os.ModeType
+}
@@ -0,0 +1,543 @@
+package memfs
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"fused/backend"
+)
+
+// mustCreate creates a regular file name in directory dir, open for reading
+// and writing
+func mustCreate(t *testing.T, fs *MemFS, dir uint64,
+	name string) (uint64, backend.HandleID) {
+	t.Helper()
+	stat, fh, err := fs.Create(
+		context.Background(), dir, name, syscall.O_RDWR, 0644, 0, 0)
+	if err != nil {
+		t.Fatalf("Create(%s): %v", name, err)
+	}
+	return stat.Ino, fh
+}
+
+func mustWrite(t *testing.T, fs *MemFS,
+	ino uint64, fh backend.HandleID, offset int64, data []byte) {
+	t.Helper()
+	if _, err := fs.Write(
+		context.Background(), ino, fh, offset, data); err != nil {
+		t.Fatalf("Write(%v, %v): %v", ino, offset, err)
+	}
+}
+
+func mustRead(t *testing.T, fs *MemFS,
+	ino uint64, fh backend.HandleID, offset int64, n int) []byte {
+	t.Helper()
+	data, err := fs.Read(context.Background(), ino, fh, offset, n)
+	if err != nil {
+		t.Fatalf("Read(%v, %v): %v", ino, offset, err)
+	}
+	return data
+}
+
+// pattern returns n bytes of data differing from block to block
+func pattern(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i/memfsBlockSize + i%251 + 1)
+	}
+	return data
+}
+
+// block returns block i of file ino
+func block(fs *MemFS, ino uint64, i int64) *memBlock {
+	inode, _ := fs.loadInode(ino)
+	return inode.blocks[i]
+}
+
+func TestCopyFileRangeShare(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+	src, sFh := mustCreate(t, fs, 1, "src")
+	dst, dFh := mustCreate(t, fs, 1, "dst")
+	data := pattern(2*memfsBlockSize + 100)
+	mustWrite(t, fs, src, sFh, 0, data)
+
+	n, err := fs.CopyFileRange(ctx, src, sFh, 0, dst, dFh, 0, 1<<20)
+	if err != nil {
+		t.Fatalf("CopyFileRange: %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("copied %v bytes, want %v", n, len(data))
+	}
+
+	// Whole blocks are shared, the partial block at the end is copied
+	for i := int64(0); i < 2; i++ {
+		b := block(fs, dst, i)
+		if b != block(fs, src, i) {
+			t.Errorf("block %v is not shared", i)
+		}
+		if b.refs != 2 {
+			t.Errorf("block %v has %v references, want 2", i, b.refs)
+		}
+	}
+	if block(fs, dst, 2) == block(fs, src, 2) {
+		t.Errorf("partial block is shared")
+	}
+	if got := mustRead(t, fs, dst, dFh, 0, 0); !bytes.Equal(got, data) {
+		t.Errorf("destination differs from source")
+	}
+
+	// Blocks at different positions within the blocks are copied
+	n, err = fs.CopyFileRange(ctx, src, sFh, 10, dst, dFh, 0, memfsBlockSize)
+	if err != nil {
+		t.Fatalf("CopyFileRange at 10: %v", err)
+	}
+	if n != memfsBlockSize {
+		t.Fatalf("copied %v bytes at 10, want %v", n, memfsBlockSize)
+	}
+	if block(fs, dst, 0) == block(fs, src, 0) {
+		t.Errorf("unaligned block is shared")
+	}
+	want := append(data[10:10+memfsBlockSize:10+memfsBlockSize],
+		data[memfsBlockSize:]...)
+	if got := mustRead(t, fs, dst, dFh, 0, 0); !bytes.Equal(got, want) {
+		t.Errorf("destination differs after unaligned copy")
+	}
+}
+
+func TestCopyFileRangeCopyOnWrite(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+	src, sFh := mustCreate(t, fs, 1, "src")
+	dst, dFh := mustCreate(t, fs, 1, "dst")
+	data := pattern(2 * memfsBlockSize)
+	mustWrite(t, fs, src, sFh, 0, data)
+	if _, err := fs.CopyFileRange(
+		ctx, src, sFh, 0, dst, dFh, 0, int64(len(data))); err != nil {
+		t.Fatalf("CopyFileRange: %v", err)
+	}
+	shared := block(fs, src, 0)
+
+	// Writing to the destination copies the block it writes to
+	mustWrite(t, fs, dst, dFh, 10, []byte("dst"))
+	if got := mustRead(t, fs, src, sFh, 0, 0); !bytes.Equal(got, data) {
+		t.Errorf("writing to destination changes source")
+	}
+	want := append([]byte{}, data...)
+	copy(want[10:], "dst")
+	if got := mustRead(t, fs, dst, dFh, 0, 0); !bytes.Equal(got, want) {
+		t.Errorf("destination does not have the data written")
+	}
+	if block(fs, dst, 0) == shared || shared.refs != 1 {
+		t.Errorf("block written to is still shared")
+	}
+	if block(fs, dst, 1) != block(fs, src, 1) {
+		t.Errorf("block not written to is no longer shared")
+	}
+
+	// So does writing to the source, and punching a hole in the destination
+	// releases the blocks it shares
+	mustWrite(t, fs, src, sFh, memfsBlockSize, []byte("src"))
+	if got := mustRead(t, fs, dst, dFh, 0, 0); !bytes.Equal(got, want) {
+		t.Errorf("writing to source changes destination")
+	}
+	if err := fs.Fallocate(ctx, dst, dFh, 0, int64(len(data)),
+		backend.FallocPunchHole|backend.FallocKeepSize); err != nil {
+		t.Fatalf("Fallocate: %v", err)
+	}
+	if got := mustRead(t, fs, src, sFh, 0, 3); !bytes.Equal(got, data[:3]) {
+		t.Errorf("punching hole in destination changes source")
+	}
+}
+
+func TestCopyFileRangeOverlap(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+	ino, fh := mustCreate(t, fs, 1, "file")
+	data := pattern(2 * memfsBlockSize)
+	mustWrite(t, fs, ino, fh, 0, data)
+
+	for _, tc := range []struct {
+		offset, dOffset, length int64
+	}{
+		{0, 100, memfsBlockSize},
+		{100, 0, memfsBlockSize},
+		{0, 0, 1},
+	} {
+		_, err := fs.CopyFileRange(
+			ctx, ino, fh, tc.offset, ino, fh, tc.dOffset, tc.length)
+		if err != syscall.EINVAL {
+			t.Errorf("copying %v bytes from %v to %v: got %v, want EINVAL",
+				tc.length, tc.offset, tc.dOffset, err)
+		}
+	}
+	if got := mustRead(t, fs, ino, fh, 0, 0); !bytes.Equal(got, data) {
+		t.Errorf("file changed by rejected copies")
+	}
+
+	// Adjacent ranges do not overlap, and the length is cut to the end of
+	// file before checking
+	n, err := fs.CopyFileRange(
+		ctx, ino, fh, memfsBlockSize, ino, fh, 0, 4*memfsBlockSize)
+	if err != nil || n != memfsBlockSize {
+		t.Fatalf("copying adjacent range: got %v, %v", n, err)
+	}
+	if block(fs, ino, 0) != block(fs, ino, 1) {
+		t.Errorf("block is not shared within the file")
+	}
+}
+
+func TestCopyFileRangeSpace(t *testing.T) {
+	fs := NewMemFS()
+	fs.Capacity = 3 * memfsBlockSize
+	ctx := context.Background()
+	src, sFh := mustCreate(t, fs, 1, "src")
+	dst, dFh := mustCreate(t, fs, 1, "dst")
+	data := pattern(2 * memfsBlockSize)
+	mustWrite(t, fs, src, sFh, 0, data)
+
+	// Shared blocks are accounted to both files
+	_, err := fs.CopyFileRange(ctx, src, sFh, 0, dst, dFh, 0, 1<<20)
+	if err != syscall.ENOSPC {
+		t.Fatalf("copying beyond capacity: got %v, want ENOSPC", err)
+	}
+	if fs.used != 2*memfsBlockSize {
+		t.Errorf("used %v bytes after failed copy, want %v",
+			fs.used, 2*memfsBlockSize)
+	}
+	n, err := fs.CopyFileRange(ctx, src, sFh, 0, dst, dFh, 0, memfsBlockSize)
+	if err != nil || n != memfsBlockSize {
+		t.Fatalf("copying a block: got %v, %v", n, err)
+	}
+	if fs.used != 3*memfsBlockSize {
+		t.Errorf("used %v bytes after copy, want %v",
+			fs.used, 3*memfsBlockSize)
+	}
+
+	// Writing to a shared block needs no more space
+	mustWrite(t, fs, dst, dFh, 0, []byte("dst"))
+
+	// Removing the source frees its space, while the destination keeps data
+	// of the blocks it shared
+	if err := fs.Unlink(ctx, 1, "src"); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+	if err := fs.Release(ctx, src, sFh, syscall.O_RDWR); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if fs.used != memfsBlockSize {
+		t.Errorf("used %v bytes after removing source, want %v",
+			fs.used, memfsBlockSize)
+	}
+	want := append([]byte("dst"), data[3:memfsBlockSize]...)
+	if got := mustRead(t, fs, dst, dFh, 0, 0); !bytes.Equal(got, want) {
+		t.Errorf("destination changed by removing source")
+	}
+}
+
+func TestLseek(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+	ino, fh := mustCreate(t, fs, 1, "file")
+	// Data in the first and third blocks, and space allocated beyond the end
+	// of file
+	mustWrite(t, fs, ino, fh, 0, []byte("data"))
+	mustWrite(t, fs, ino, fh, 2*memfsBlockSize, []byte("data"))
+	if err := fs.Fallocate(ctx, ino, fh, 3*memfsBlockSize, memfsBlockSize,
+		backend.FallocKeepSize); err != nil {
+		t.Fatalf("Fallocate: %v", err)
+	}
+	size := int64(2*memfsBlockSize + 4)
+
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		want   int64
+		err    error
+	}{
+		{0, backend.SeekData, 0, nil},
+		{0, backend.SeekHole, memfsBlockSize, nil},
+		{10, backend.SeekData, 10, nil},
+		{memfsBlockSize, backend.SeekData, 2 * memfsBlockSize, nil},
+		{memfsBlockSize + 5, backend.SeekHole, memfsBlockSize + 5, nil},
+		// There is a hole at the end of file
+		{2 * memfsBlockSize, backend.SeekHole, size, nil},
+		{size, backend.SeekData, 0, syscall.ENXIO},
+		{size, backend.SeekHole, 0, syscall.ENXIO},
+		{-1, backend.SeekData, 0, syscall.ENXIO},
+		{0, 0, 0, syscall.EINVAL},
+	} {
+		got, err := fs.Lseek(ctx, ino, fh, tc.offset, tc.whence)
+		if got != tc.want || err != tc.err {
+			t.Errorf("Lseek(%v, %v): got %v, %v, want %v, %v",
+				tc.offset, tc.whence, got, err, tc.want, tc.err)
+		}
+	}
+
+	// Space allocated beyond the end of file is no data
+	if err := fs.Fallocate(ctx, ino, fh, 0, 2*memfsBlockSize,
+		backend.FallocPunchHole|backend.FallocKeepSize); err != nil {
+		t.Fatalf("Fallocate: %v", err)
+	}
+	if err := fs.Fallocate(ctx, ino, fh, 2*memfsBlockSize, memfsBlockSize,
+		backend.FallocPunchHole|backend.FallocKeepSize); err != nil {
+		t.Fatalf("Fallocate: %v", err)
+	}
+	_, err := fs.Lseek(ctx, ino, fh, 0, backend.SeekData)
+	if err != syscall.ENXIO {
+		t.Errorf("seeking data in a hole: got %v, want ENXIO", err)
+	}
+}
+
+func mustMkdir(t *testing.T, fs *MemFS, dir uint64, name string) uint64 {
+	t.Helper()
+	stat, err := fs.Mkdir(
+		context.Background(), dir, name, os.ModeDir|0755, 0, 0)
+	if err != nil {
+		t.Fatalf("Mkdir(%s): %v", name, err)
+	}
+	return stat.Ino
+}
+
+func mustLookup(t *testing.T, fs *MemFS, dir uint64,
+	name string) *backend.Stat {
+	t.Helper()
+	stat, err := fs.Lookup(context.Background(), dir, name)
+	if err != nil {
+		t.Fatalf("Lookup(%v, %s): %v", dir, name, err)
+	}
+	return stat
+}
+
+func mustStat(t *testing.T, fs *MemFS, ino uint64) *backend.Stat {
+	t.Helper()
+	stat, err := fs.Stat(context.Background(), ino)
+	if err != nil {
+		t.Fatalf("Stat(%v): %v", ino, err)
+	}
+	return stat
+}
+
+// checkDir checks the link count of directory ino, and its parent
+func checkDir(t *testing.T, fs *MemFS, ino uint64, nlink uint32,
+	parent uint64) {
+	t.Helper()
+	if stat := mustStat(t, fs, ino); stat.Nlink != nlink {
+		t.Errorf("directory %v has %v links, want %v", ino, stat.Nlink, nlink)
+	}
+	if got := mustLookup(t, fs, ino, "..").Ino; got != parent {
+		t.Errorf("parent of directory %v: got %v, want %v", ino, got, parent)
+	}
+}
+
+func TestRenameExchange(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+	a, b := mustMkdir(t, fs, 1, "a"), mustMkdir(t, fs, 1, "b")
+	x, y := mustMkdir(t, fs, a, "x"), mustMkdir(t, fs, b, "y")
+	f, _ := mustCreate(t, fs, b, "f")
+
+	// Directories exchanged across parents change their parents, while the
+	// link counts of the parents stay
+	err := fs.Rename(ctx, a, "x", b, "y", backend.RenameExchange)
+	if err != nil {
+		t.Fatalf("exchanging directories: %v", err)
+	}
+	if got := mustLookup(t, fs, a, "x").Ino; got != y {
+		t.Errorf("a/x: got %v, want %v", got, y)
+	}
+	if got := mustLookup(t, fs, b, "y").Ino; got != x {
+		t.Errorf("b/y: got %v, want %v", got, x)
+	}
+	checkDir(t, fs, a, 3, 1)
+	checkDir(t, fs, b, 3, 1)
+	checkDir(t, fs, x, 2, b)
+	checkDir(t, fs, y, 2, a)
+
+	// A directory exchanged with a file moves a link to the directory
+	err = fs.Rename(ctx, a, "x", b, "f", backend.RenameExchange)
+	if err != nil {
+		t.Fatalf("exchanging directory and file: %v", err)
+	}
+	if got := mustLookup(t, fs, a, "x").Ino; got != f {
+		t.Errorf("a/x: got %v, want %v", got, f)
+	}
+	checkDir(t, fs, a, 2, 1)
+	checkDir(t, fs, b, 4, 1)
+	checkDir(t, fs, y, 2, b)
+
+	for _, tc := range []struct {
+		sIno  uint64
+		sName string
+		dIno  uint64
+		dName string
+		flags uint32
+		err   error
+	}{
+		// Both names must exist
+		{a, "x", b, "z", backend.RenameExchange, syscall.ENOENT},
+		// Exchanging may not be combined with other flags
+		{a, "x", b, "f", backend.RenameExchange | backend.RenameNoreplace,
+			syscall.EINVAL},
+		// Neither directory may be moved into the other
+		{1, "b", y, "z", backend.RenameExchange, syscall.EINVAL},
+		{y, "z", 1, "b", backend.RenameExchange, syscall.EINVAL},
+	} {
+		err := fs.Rename(ctx, tc.sIno, tc.sName, tc.dIno, tc.dName, tc.flags)
+		if err != tc.err {
+			t.Errorf("exchanging <%v, %s> and <%v, %s>: got %v, want %v",
+				tc.sIno, tc.sName, tc.dIno, tc.dName, err, tc.err)
+		}
+	}
+}
+
+func TestRenameNoreplace(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+	a, _ := mustCreate(t, fs, 1, "a")
+	b, _ := mustCreate(t, fs, 1, "b")
+
+	err := fs.Rename(ctx, 1, "a", 1, "b", backend.RenameNoreplace)
+	if err != syscall.EEXIST {
+		t.Fatalf("renaming to existing name: got %v, want EEXIST", err)
+	}
+	if got := mustLookup(t, fs, 1, "a").Ino; got != a {
+		t.Errorf("a: got %v, want %v", got, a)
+	}
+	if got := mustLookup(t, fs, 1, "b").Ino; got != b {
+		t.Errorf("b: got %v, want %v", got, b)
+	}
+
+	err = fs.Rename(ctx, 1, "a", 1, "c", backend.RenameNoreplace)
+	if err != nil {
+		t.Fatalf("renaming to new name: %v", err)
+	}
+	if got := mustLookup(t, fs, 1, "c").Ino; got != a {
+		t.Errorf("c: got %v, want %v", got, a)
+	}
+}
+
+func TestRenameWhiteout(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+	a, _ := mustCreate(t, fs, 1, "a")
+	d := mustMkdir(t, fs, 1, "d")
+	e := mustMkdir(t, fs, 1, "e")
+	mustMkdir(t, fs, e, "f")
+
+	// The whiteout is a character device numbered 0:0 in place of the old
+	// name
+	err := fs.Rename(ctx, 1, "a", 1, "b", backend.RenameWhiteout)
+	if err != nil {
+		t.Fatalf("renaming with whiteout: %v", err)
+	}
+	if got := mustLookup(t, fs, 1, "b").Ino; got != a {
+		t.Errorf("b: got %v, want %v", got, a)
+	}
+	stat := mustLookup(t, fs, 1, "a")
+	if stat.Ino == a || stat.Mode.Type() != os.ModeDevice|os.ModeCharDevice ||
+		stat.Rdev != 0 {
+		t.Errorf("whiteout: got %+v", stat)
+	}
+
+	// Failing to allocate the whiteout, or failing to replace the new name
+	// after allocating it, leaves everything unchanged
+	inodes := fs.inodes
+	fs.MaxInodes = inodes
+	err = fs.Rename(ctx, 1, "b", 1, "c", backend.RenameWhiteout)
+	if err != syscall.ENOSPC {
+		t.Errorf("renaming with no inode left: got %v, want ENOSPC", err)
+	}
+	fs.MaxInodes = inodes + 1
+	err = fs.Rename(ctx, 1, "d", 1, "e", backend.RenameWhiteout)
+	if err != syscall.ENOTEMPTY {
+		t.Errorf("replacing non-empty directory: got %v, want ENOTEMPTY",
+			err)
+	}
+	if fs.inodes != inodes {
+		t.Errorf("%v inodes after failed renames, want %v", fs.inodes, inodes)
+	}
+	if got := mustLookup(t, fs, 1, "b").Ino; got != a {
+		t.Errorf("b: got %v, want %v", got, a)
+	}
+	if got := mustLookup(t, fs, 1, "d").Ino; got != d {
+		t.Errorf("d: got %v, want %v", got, d)
+	}
+	if _, err := fs.Lookup(ctx, 1, "c"); err != syscall.ENOENT {
+		t.Errorf("c: got %v, want ENOENT", err)
+	}
+
+	// The whiteout is allocated once there is an inode left
+	err = fs.Rename(ctx, 1, "b", 1, "c", backend.RenameWhiteout)
+	if err != nil {
+		t.Fatalf("renaming with whiteout: %v", err)
+	}
+	if fs.inodes != inodes+1 {
+		t.Errorf("%v inodes after rename, want %v", fs.inodes, inodes+1)
+	}
+}
+
+func TestRenameDir(t *testing.T) {
+	fs := NewMemFS()
+	ctx := context.Background()
+	a := mustMkdir(t, fs, 1, "a")
+	b := mustMkdir(t, fs, a, "b")
+	c := mustMkdir(t, fs, b, "c")
+	d := mustMkdir(t, fs, 1, "d")
+	mustMkdir(t, fs, d, "e")
+	mustMkdir(t, fs, 1, "empty")
+
+	// A directory may not be moved into itself or its descendants
+	for _, dIno := range []uint64{a, b, c} {
+		err := fs.Rename(ctx, 1, "a", dIno, "x", 0)
+		if err != syscall.EINVAL {
+			t.Errorf("moving a into %v: got %v, want EINVAL", dIno, err)
+		}
+	}
+	if err := fs.checkLoop(b, "c", a); err != nil {
+		t.Errorf("checking move of c into a: %v", err)
+	}
+	if err := fs.checkLoop(1, "a", c); err != syscall.EINVAL {
+		t.Errorf("checking move of a into c: got %v, want EINVAL", err)
+	}
+
+	// Only an empty directory may be replaced
+	err := fs.Rename(ctx, 1, "a", 1, "d", 0)
+	if err != syscall.ENOTEMPTY {
+		t.Errorf("replacing non-empty directory: got %v, want ENOTEMPTY",
+			err)
+	}
+	checkDir(t, fs, a, 3, 1)
+	checkDir(t, fs, d, 3, 1)
+
+	// Moving a directory moves a link from the old parent to the new one
+	if err := fs.Rename(ctx, b, "c", d, "c", 0); err != nil {
+		t.Fatalf("moving c into d: %v", err)
+	}
+	checkDir(t, fs, b, 2, a)
+	checkDir(t, fs, d, 4, 1)
+	checkDir(t, fs, c, 2, d)
+
+	// Replacing an empty directory removes its link from the new parent
+	if err := fs.Rename(ctx, a, "b", 1, "empty", 0); err != nil {
+		t.Fatalf("moving b over empty: %v", err)
+	}
+	if got := mustStat(t, fs, 1).Nlink; got != 5 {
+		t.Errorf("root directory has %v links, want 5", got)
+	}
+	checkDir(t, fs, a, 2, 1)
+	checkDir(t, fs, b, 2, 1)
+
+	// Renaming within a directory changes no link
+	if err := fs.Rename(ctx, 1, "empty", 1, "b", 0); err != nil {
+		t.Fatalf("renaming b: %v", err)
+	}
+	if got := mustStat(t, fs, 1).Nlink; got != 5 {
+		t.Errorf("root directory has %v links, want 5", got)
+	}
+	checkDir(t, fs, b, 2, 1)
+}
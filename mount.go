@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+
+	"fused/backend"
+	"fused/fusefs"
+)
+
+// mountOptions are the options given by -o which fused handles itself, as
+// opposed to those of the filesystem type
+type mountOptions struct {
+	mount              []fuse.MountOption
+	fsname             string
+	subtype            string
+	defaultPermissions bool
+	override           fusefs.AttrOverride
+	cache              []func(*backend.CacheConfig)
+	foreground         bool
+
+	// Options passed to the filesystem type
+	backend []string
+}
+
+// ignoredOptions are options of mount(8) and fstab which mean nothing to a
+// FUSE filesystem, or are defaults of it
+var ignoredOptions = map[string]bool{
+	"defaults": true, "rw": true, "auto": true, "noauto": true,
+	"user": true, "users": true, "nouser": true, "owner": true,
+	"group": true, "_netdev": true, "nofail": true, "exec": true,
+	"async": true, "nodev": true, "nosuid": true, "comment": true,
+}
+
+// unsupportedOptions are options of mount(8) which fused cannot honour. They
+// are an error, unless sloppy, rather than being ignored silently.
+var unsupportedOptions = map[string]bool{
+	"noexec": true, "sync": true, "dirsync": true, "mand": true,
+	"allow_root": true,
+}
+
+// parseMountOptions splits opts into the standard mount options and those
+// of b. If sloppy, options unknown to b and options fused cannot honour are
+// dropped instead of being an error.
+func parseMountOptions(
+	b *backend.Backend, opts []string, sloppy bool) (*mountOptions, error) {
+	m := &mountOptions{fsname: b.Name, subtype: b.Name}
+	for _, opt := range opts {
+		key, value := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			key, value = opt[:i], opt[i+1:]
+		}
+		if ignoredOptions[key] || strings.HasPrefix(key, "x-") {
+			continue
+		}
+		if unsupportedOptions[key] {
+			if sloppy {
+				continue
+			}
+			return nil, fmt.Errorf("option %s is not supported", key)
+		}
+		switch key {
+		case "ro":
+			m.mount = append(m.mount, fuse.ReadOnly())
+		case "allow_other":
+			m.mount = append(m.mount, fuse.AllowOther())
+		case "dev":
+			m.mount = append(m.mount, fuse.AllowDev())
+		case "suid":
+			m.mount = append(m.mount, fuse.AllowSUID())
+		case "nonempty":
+			m.mount = append(m.mount, fuse.AllowNonEmptyMount())
+		case "default_permissions":
+			m.defaultPermissions = true
+		case "foreground":
+			m.foreground = true
+		case "fsname":
+			m.fsname = value
+		case "subtype":
+			m.subtype = value
+		case "uid", "gid":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("option %s: %q is not an id", key, value)
+			}
+			if key == "uid" {
+				m.override.SetUID, m.override.UID = true, uint32(id)
+			} else {
+				m.override.SetGID, m.override.GID = true, uint32(id)
+			}
+		case "umask":
+			mask, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mask > 0777 {
+				return nil, fmt.Errorf("option umask: %q is not a umask", value)
+			}
+			m.override.SetUmask = true
+			m.override.Umask = os.FileMode(mask)
+		case "attr_timeout", "entry_timeout":
+			d, err := parseTimeout(value)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"option %s: %q is not a timeout", key, value)
+			}
+			if key == "attr_timeout" {
+				m.setCache(func(c *backend.CacheConfig) { c.AttrTimeout = d })
+			} else {
+				m.setCache(func(c *backend.CacheConfig) { c.EntryTimeout = d })
+			}
+		case "kernel_cache", "keep_cache":
+			m.setCache(func(c *backend.CacheConfig) { c.KeepCache = true })
+		case "direct_io":
+			m.setCache(func(c *backend.CacheConfig) { c.DirectIO = true })
+		case "writeback_cache":
+			m.setCache(func(c *backend.CacheConfig) { c.WritebackCache = true })
+		case "noatime", "relatime", "strictatime":
+			// The atime policy is up to the filesystem type, if it has one
+			if hasOption(b, "atime") {
+				m.backend = append(m.backend, "atime="+key)
+			}
+		default:
+			if sloppy && !hasOption(b, key) {
+				continue
+			}
+			m.backend = append(m.backend, opt)
+		}
+	}
+	return m, nil
+}
+
+func (m *mountOptions) setCache(set func(*backend.CacheConfig)) {
+	m.cache = append(m.cache, set)
+}
+
+// hasOption reports whether b declares the option name
+func hasOption(b *backend.Backend, name string) bool {
+	for _, o := range b.Options {
+		if o.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimeout parses a timeout in seconds, as libfuse takes it, or a
+// duration such as "1m30s"
+func parseTimeout(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		if secs < 0 {
+			return 0, strconv.ErrRange
+		}
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// helperArgs are the arguments "type mountpoint [-sfnv] [-o options]" fused
+// takes as a mount helper, either run by mount(8) as mount.fused, or by
+// mount.fuse of libfuse for filesystems of type fuse.fused. The source of the
+// mount names the filesystem type, so an fstab entry reads:
+//
+//	memfs  /mnt/mem  fuse.fused  allow_other,capacity=1G  0 0
+type helperArgs struct {
+	fstype     string
+	mountpoint string
+	options    optionList
+	fake       bool // Parse the arguments, but do not mount (-f)
+	sloppy     bool // Ignore options unknown to the filesystem type (-s)
+}
+
+// isHelperName reports whether fused is run by the name of a mount helper,
+// in which case all its arguments are those of a mount helper
+func isHelperName(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), "mount.")
+}
+
+// parseHelperArgs parses the arguments of a mount helper
+func parseHelperArgs(args []string) (*helperArgs, error) {
+	h := &helperArgs{}
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' {
+			positional = append(positional, arg)
+			continue
+		}
+		switch arg[1] {
+		case 'o', 't', 'N':
+			value := arg[2:]
+			if value == "" {
+				if i++; i >= len(args) {
+					return nil, fmt.Errorf("%s needs a value", arg)
+				}
+				value = args[i]
+			}
+			if arg[1] == 'o' {
+				h.options.Set(value)
+			}
+			continue
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'f':
+				h.fake = true
+			case 's':
+				h.sloppy = true
+			case 'n', 'v':
+				// fused keeps no mtab and logs anyway
+			default:
+				return nil, fmt.Errorf("unknown flag -%c", c)
+			}
+		}
+	}
+	if len(positional) != 2 {
+		return nil, errors.New("expected a type and a mountpoint")
+	}
+	h.fstype, h.mountpoint = positional[0], positional[1]
+	return h, nil
+}
+
+// daemonEnv is set in the environment of fused run in the background by
+// daemonize, and readyFd is the pipe it reports whether the mount succeeded
+const (
+	daemonEnv = "FUSED_DAEMON"
+	readyFd   = 3
+)
+
+// daemonize runs fused again in the background with the same arguments, and
+// exits once it reports if the filesystem is mounted, as mount(8) expects
+// of a mount helper. It returns in the background process.
+func daemonize() {
+	if os.Getenv(daemonEnv) != "" {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cmd := exec.Command(exe)
+	cmd.Args = os.Args
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.ExtraFiles = []*os.File{w} // readyFd
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	w.Close()
+
+	// The pipe is closed without "ok" if the mount fails or fused dies
+	status, _ := ioutil.ReadAll(r)
+	if string(status) == "ok" {
+		os.Exit(0)
+	}
+	if len(status) == 0 {
+		status = []byte("fused exited before mounting")
+	}
+	fmt.Fprintln(os.Stderr, string(status))
+	os.Exit(1)
+}
+
+var readyOnce sync.Once
+
+// notifyReady reports the result of mounting to the process which started
+// fused in the background, if any
+func notifyReady(err error) {
+	if os.Getenv(daemonEnv) == "" {
+		return
+	}
+	readyOnce.Do(func() {
+		f := os.NewFile(readyFd, "ready")
+		if err == nil {
+			f.WriteString("ok")
+		} else {
+			f.WriteString(err.Error())
+		}
+		f.Close()
+	})
+}
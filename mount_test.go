@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"fused/backend"
+	"fused/fusefs"
+)
+
+var testBackend = &backend.Backend{
+	Name: "test",
+	Options: []backend.Option{{
+		Name: "capacity",
+		Type: backend.OptionSize,
+	}, {
+		Name:    "atime",
+		Type:    backend.OptionString,
+		Choices: []string{"relatime", "strictatime", "noatime"},
+	}},
+}
+
+func TestParseMountOptions(t *testing.T) {
+	m, err := parseMountOptions(testBackend, []string{
+		"defaults", "rw", "nofail", "x-systemd.automount", "ro",
+		"allow_other", "default_permissions", "foreground",
+		"fsname=mem", "uid=1000", "gid=100", "umask=022",
+		"attr_timeout=1.5", "entry_timeout=1m", "kernel_cache",
+		"writeback_cache", "noatime", "capacity=1G",
+	}, false)
+	if err != nil {
+		t.Fatalf("parseMountOptions: %v", err)
+	}
+	if len(m.mount) != 2 {
+		t.Errorf("got %d mount options, want 2 (ro, allow_other)",
+			len(m.mount))
+	}
+	if !m.defaultPermissions || !m.foreground {
+		t.Errorf("default_permissions %v, foreground %v: want both true",
+			m.defaultPermissions, m.foreground)
+	}
+	if m.fsname != "mem" || m.subtype != "test" {
+		t.Errorf("fsname %q, subtype %q: want mem and test",
+			m.fsname, m.subtype)
+	}
+	override := fusefs.AttrOverride{SetUID: true, UID: 1000,
+		SetGID: true, GID: 100, SetUmask: true, Umask: 022}
+	if m.override != override {
+		t.Errorf("override: got %+v, want %+v", m.override, override)
+	}
+	var cache backend.CacheConfig
+	for _, set := range m.cache {
+		set(&cache)
+	}
+	wantCache := backend.CacheConfig{AttrTimeout: 1500 * time.Millisecond,
+		EntryTimeout: time.Minute, KeepCache: true, WritebackCache: true}
+	if cache != wantCache {
+		t.Errorf("cache: got %+v, want %+v", cache, wantCache)
+	}
+	if want := []string{"atime=noatime", "capacity=1G"}; !reflect.DeepEqual(
+		m.backend, want) {
+		t.Errorf("backend options: got %q, want %q", m.backend, want)
+	}
+}
+
+func TestParseMountOptionsErrors(t *testing.T) {
+	for _, opts := range [][]string{
+		{"uid=root"},
+		{"gid=-1"},
+		{"umask=8"},
+		{"umask=1777"},
+		{"attr_timeout=-1"},
+		{"entry_timeout=soon"},
+		{"noexec"},
+		{"sync"},
+		{"allow_root"},
+	} {
+		if _, err := parseMountOptions(testBackend, opts, false); err == nil {
+			t.Errorf("parseMountOptions(%q) succeeds, want an error", opts)
+		}
+	}
+}
+
+func TestParseMountOptionsSloppy(t *testing.T) {
+	opts := []string{"noexec", "sync", "unknown=1", "capacity=1G"}
+	m, err := parseMountOptions(testBackend, opts, true)
+	if err != nil {
+		t.Fatalf("parseMountOptions: %v", err)
+	}
+	if want := []string{"capacity=1G"}; !reflect.DeepEqual(m.backend, want) {
+		t.Errorf("backend options: got %q, want %q", m.backend, want)
+	}
+
+	// Without -s, options unknown to the filesystem type are left to it
+	m, err = parseMountOptions(testBackend, opts[2:], false)
+	if err != nil {
+		t.Fatalf("parseMountOptions: %v", err)
+	}
+	if !reflect.DeepEqual(m.backend, opts[2:]) {
+		t.Errorf("backend options: got %q, want %q", m.backend, opts[2:])
+	}
+}
+
+func TestParseHelperArgs(t *testing.T) {
+	h, err := parseHelperArgs([]string{"memfs", "/mnt/mem", "-sn",
+		"-o", "rw,capacity=1G", "-t", "fuse.fused", "-oallow_other"})
+	if err != nil {
+		t.Fatalf("parseHelperArgs: %v", err)
+	}
+	want := &helperArgs{
+		fstype:     "memfs",
+		mountpoint: "/mnt/mem",
+		options:    optionList{"rw", "capacity=1G", "allow_other"},
+		sloppy:     true,
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got %+v, want %+v", h, want)
+	}
+
+	h, err = parseHelperArgs([]string{"-f", "memfs", "/mnt/mem"})
+	if err != nil {
+		t.Fatalf("parseHelperArgs: %v", err)
+	}
+	if !h.fake || h.sloppy || h.fstype != "memfs" {
+		t.Errorf("-f: got %+v, want fake only", h)
+	}
+}
+
+func TestParseHelperArgsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"memfs"},
+		{"memfs", "/mnt/mem", "extra"},
+		{"memfs", "/mnt/mem", "-o"},
+		{"memfs", "/mnt/mem", "-x"},
+		{"memfs", "/mnt/mem", "-fx"},
+	} {
+		if _, err := parseHelperArgs(args); err == nil {
+			t.Errorf("parseHelperArgs(%q) succeeds, want an error", args)
+		}
+	}
+}
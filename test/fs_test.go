@@ -729,3 +729,120 @@ func TestConcurrentRenames(t *testing.T) {
 		t.Fatalf("# of succeeded renames is %d instead of 1", count)
 	}
 }
+
+func TestConcurrentAppends(t *testing.T) {
+	testfile := realpath("testfile-" + randstring(8))
+	fd, err := creat(testfile, 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := syscall.Close(fd); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer syscall.Unlink(testfile)
+
+	log.Printf("Test: Concurrent appends ...")
+	nwriters := 8
+	nwrites := 16
+	record := 64
+	wg := sync.WaitGroup{}
+	wg.Add(nwriters)
+	for w := 0; w < nwriters; w++ {
+		go func(writer int) {
+			defer wg.Done()
+
+			fd, err := syscall.Open(
+				testfile, syscall.O_WRONLY|syscall.O_APPEND, 0)
+			if err != nil {
+				t.Errorf("Writer %v: open %s: %v", writer, testfile, err)
+				return
+			}
+			defer syscall.Close(fd)
+
+			data := bytes.Repeat([]byte{byte('a' + writer)}, record)
+			for i := 0; i < nwrites; i++ {
+				if err := write(fd, data, true); err != nil {
+					t.Errorf("Writer %v: write %s: %v", writer, testfile, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	// Every record should be written as a whole, none overwritten
+	if err := checkFileSize(testfile, int64(nwriters*nwrites*record)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	f, err := os.Open(testfile)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer f.Close()
+	buff := make([]byte, record)
+	for i := 0; i < nwriters*nwrites; i++ {
+		if _, err := io.ReadFull(f, buff); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !bytes.Equal(buff, bytes.Repeat(buff[:1], record)) {
+			t.Fatalf("record %d is interleaved: '%s'", i, string(buff))
+		}
+	}
+	log.Printf(" ... Passed")
+}
+
+func TestWriteToReadOnlyFile(t *testing.T) {
+	testfile := realpath("testfile-" + randstring(8))
+	fd, err := creatWithContent(testfile, []byte("hello, world"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer syscall.Unlink(testfile)
+	if err := syscall.Close(fd); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	fd, err = syscall.Open(testfile, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer syscall.Close(fd)
+	_, err = syscall.Write(fd, []byte("hello"))
+	if err != syscall.EBADF {
+		t.Fatalf("Error expected '%s', but got '%v'", syscall.EBADF, err)
+	}
+}
+
+func TestSparseFile(t *testing.T) {
+	testfile := realpath("testfile-" + randstring(8))
+	fd, err := creat(testfile, 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer syscall.Unlink(testfile)
+	defer syscall.Close(fd)
+
+	// Writing a byte far beyond the end of file leaves a hole, which should
+	// not be allocated
+	offset := int64(1 << 30)
+	if _, err := syscall.Pwrite(fd, []byte("x"), offset); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if stat.Size != offset+1 {
+		t.Fatalf("file size: expected %v, but got %v", offset+1, stat.Size)
+	}
+	if stat.Blocks*512 >= offset {
+		t.Fatalf("hole is allocated: %v blocks", stat.Blocks)
+	}
+	if err := checkFileContentAt(
+		testfile, int(offset)-4, []byte{0, 0, 0, 0, 'x'}); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
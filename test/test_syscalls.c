@@ -2105,20 +2105,20 @@ int main(int argc, char *argv[])
 	err += test_create();
 	err += test_create_unlink();
 	err += test_create_unlink_create();
-	// err += test_symlink();
+	err += test_symlink();
 	err += test_link();
 	err += test_link2();
-// #ifndef __FreeBSD__	
-// 	err += test_mknod();
-// 	err += test_mkfifo();
-// #endif
+#ifndef __FreeBSD__	
+	err += test_mknod();
+	err += test_mkfifo();
+#endif
 	err += test_mkdir();
 	err += test_rename_file();
 	err += test_rename_dir();
 	err += test_rename_dir_loop();
 	err += test_seekdir();
 	err += test_rmdir();
-	//err += test_socket();
+	err += test_socket();
 	err += test_utime();
 	err += test_truncate(0);
 	err += test_truncate(testdatalen / 2);
@@ -2154,21 +2154,21 @@ int main(int argc, char *argv[])
 	err += test_open(1, O_RDWR | O_CREAT | O_EXCL, 0600);
 	err += test_open(0, O_RDWR | O_CREAT | O_EXCL, 0000);
 	err += test_open(1, O_RDWR | O_CREAT | O_EXCL, 0000);
-	// err += test_open_acc(O_RDONLY, 0600, 0);
-	// err += test_open_acc(O_WRONLY, 0600, 0);
-	// err += test_open_acc(O_RDWR,   0600, 0);
-	// err += test_open_acc(O_RDONLY, 0400, 0);
-	// err += test_open_acc(O_WRONLY, 0200, 0);
-	// if(!is_root) {
-	// 	err += test_open_acc(O_RDONLY | O_TRUNC, 0400, EACCES);
-	// 	err += test_open_acc(O_WRONLY, 0400, EACCES);
-	// 	err += test_open_acc(O_RDWR,   0400, EACCES);
-	// 	err += test_open_acc(O_RDONLY, 0200, EACCES);
-	// 	err += test_open_acc(O_RDWR,   0200, EACCES);
-	// 	err += test_open_acc(O_RDONLY, 0000, EACCES);
-	// 	err += test_open_acc(O_WRONLY, 0000, EACCES);
-	// 	err += test_open_acc(O_RDWR,   0000, EACCES);
-	// }
+	err += test_open_acc(O_RDONLY, 0600, 0);
+	err += test_open_acc(O_WRONLY, 0600, 0);
+	err += test_open_acc(O_RDWR,   0600, 0);
+	err += test_open_acc(O_RDONLY, 0400, 0);
+	err += test_open_acc(O_WRONLY, 0200, 0);
+	if(!is_root) {
+		err += test_open_acc(O_RDONLY | O_TRUNC, 0400, EACCES);
+		err += test_open_acc(O_WRONLY, 0400, EACCES);
+		err += test_open_acc(O_RDWR,   0400, EACCES);
+		err += test_open_acc(O_RDONLY, 0200, EACCES);
+		err += test_open_acc(O_RDWR,   0200, EACCES);
+		err += test_open_acc(O_RDONLY, 0000, EACCES);
+		err += test_open_acc(O_WRONLY, 0000, EACCES);
+		err += test_open_acc(O_RDWR,   0000, EACCES);
+	}
 	err += test_create_ro_dir(O_CREAT);
 	err += test_create_ro_dir(O_CREAT | O_EXCL);
 	err += test_create_ro_dir(O_CREAT | O_WRONLY);